@@ -0,0 +1,144 @@
+package ratelimit
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrUnknownAlgorithm   = errors.New("Unknown algorithm")
+	ErrAlgorithmNoStorage = errors.New("Algorithm is not supported by the storage")
+	ErrBurstAlgorithm     = errors.New("Burst is only supported by the token bucket")
+)
+
+// An algorithm keeps the usage of keys in a storage. The limiters
+// serialize the requests that share a key, so an algorithm may read the
+// state of a key and write it back without further locking.
+type algorithm interface {
+	// post consumes the tokens of a POST request, or only checks that
+	// they could be consumed if peek is set.
+	post(storage Storage, settings settings, now time.Time, req request, peek bool) response
+	get(storage Storage, settings settings, now time.Time, req request) response
+	refund(storage Storage, settings settings, now time.Time, req request) response
+	remove(storage Storage, settings settings, now time.Time, req request) response
+}
+
+var algorithms = map[string]algorithm{
+	AlgorithmTokenBucket:   tokenBucketAlgorithm{},
+	AlgorithmGCRA:          gcraAlgorithm{},
+	AlgorithmSlidingLog:    slidingLogAlgorithm{},
+	AlgorithmSlidingWindow: slidingWindowAlgorithm{},
+	AlgorithmFixedWindow:   fixedWindowAlgorithm{},
+	AlgorithmLeakyBucket:   leakyBucketAlgorithm{},
+}
+
+// IsAlgorithm reports whether name is one of the Algorithm constants.
+func IsAlgorithm(name string) bool {
+	_, ok := algorithms[name]
+	return ok
+}
+
+// Options are the optional parameters of the limiter calls that take
+// them. The zero value uses AlgorithmTokenBucket.
+type Options struct {
+	// Algorithm is the one of the Algorithm constants that keeps the
+	// usage of the key. Every algorithm keeps its own state, so a key has
+	// to be read, refunded and deleted with the algorithm it was posted
+	// with.
+	Algorithm string
+	// Burst makes a token bucket hold burst tokens instead of its limit,
+	// while it keeps refilling at limit tokens per duration. Zero is the
+	// limit. Only AlgorithmTokenBucket supports it.
+	Burst int64
+}
+
+// lookupAlgorithm returns the algorithm called name, defaulting to the
+// token bucket.
+func lookupAlgorithm(name string) (algorithm, error) {
+	if name == "" {
+		name = AlgorithmTokenBucket
+	}
+	alg, ok := algorithms[name]
+	if !ok {
+		return nil, ErrUnknownAlgorithm
+	}
+	return alg, nil
+}
+
+// lookupBurstAlgorithm is lookupAlgorithm for a request with burst, which
+// only the token bucket supports.
+func lookupBurstAlgorithm(name string, burst int64) (algorithm, error) {
+	alg, err := lookupAlgorithm(name)
+	if err == nil && burst != 0 && alg != algorithms[AlgorithmTokenBucket] {
+		return nil, ErrBurstAlgorithm
+	}
+	return alg, err
+}
+
+// stateKey keeps apart the states of algorithms that share the same
+// storage methods.
+func stateKey(algorithm, key string) string {
+	return algorithm + ":" + key
+}
+
+// tokenBucketAlgorithm keeps a TokenBucket per key in the Storage itself.
+type tokenBucketAlgorithm struct{}
+
+func (tokenBucketAlgorithm) post(storage Storage, settings settings, now time.Time, req request, peek bool) response {
+	bucket, err := storage.Get(req.ctx, req.key)
+	if err != nil {
+		return response{err: err}
+	}
+	if peek && bucket != nil {
+		// Storages may hand out the bucket they keep, so a dry run
+		// consumes from a copy
+		copied := *bucket
+		bucket = &copied
+	}
+
+	bucket = postBucket(bucket, req.limit, req.burst, req.duration, settings.migration, now)
+
+	err = bucket.ConsumeAt(req.count, now)
+	if err != nil {
+		return response{result: newResult(bucket, req.count, now), err: err}
+	}
+	if peek {
+		return response{result: newResult(bucket, 0, now)}
+	}
+	err = storage.Set(req.ctx, req.key, bucket, bucketExpire(bucket, now))
+	if err != nil {
+		return response{err: err}
+	}
+	return response{result: newResult(bucket, 0, now)}
+}
+
+func (tokenBucketAlgorithm) get(storage Storage, _ settings, now time.Time, req request) response {
+	bucket, err := storage.Get(req.ctx, req.key)
+	if err != nil {
+		return response{err: err}
+	}
+	if bucket == nil {
+		return response{err: ErrNotFound}
+	}
+	return response{result: newResult(bucket, req.count, now)}
+}
+
+func (tokenBucketAlgorithm) refund(storage Storage, _ settings, now time.Time, req request) response {
+	bucket, err := storage.Get(req.ctx, req.key)
+	if err != nil {
+		return response{err: err}
+	}
+	if bucket == nil {
+		return response{err: ErrNotFound}
+	}
+	bucket.RefundAt(req.count, now)
+	err = storage.Set(req.ctx, req.key, bucket, bucketExpire(bucket, now))
+	if err != nil {
+		return response{err: err}
+	}
+	return response{result: newResult(bucket, 0, now)}
+}
+
+func (tokenBucketAlgorithm) remove(storage Storage, _ settings, _ time.Time, req request) response {
+	return response{err: storage.Delete(req.ctx, req.key)}
+}
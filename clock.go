@@ -0,0 +1,44 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// A Clock tells the limiters and their buckets what time it is, so that
+// refills can be driven by a FakeClock in tests.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// SystemClock is the wall clock. Limiters use it unless told otherwise.
+var SystemClock Clock = systemClock{}
+
+// FakeClock is a Clock that only moves when it is told to.
+type FakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
@@ -0,0 +1,49 @@
+package ratelimit
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrDebtAlgorithm = errors.New("Charge is only supported by the token bucket")
+)
+
+// charge consumes the tokens of req from the bucket of req.key whether or
+// not they are available. The result is as of after the charge, so its
+// RetryAfter is how long the key has to wait for its next token.
+func (tokenBucketAlgorithm) charge(storage Storage, settings settings, now time.Time, req request) response {
+	bucket, err := storage.Get(req.ctx, req.key)
+	if err != nil {
+		return response{err: err}
+	}
+	bucket = postBucket(bucket, req.limit, req.burst, req.duration, settings.migration, now)
+	bucket.ChargeAt(req.count, now)
+	err = storage.Set(req.ctx, req.key, bucket, bucketExpire(bucket, now))
+	if err != nil {
+		return response{err: err}
+	}
+	return response{result: newResult(bucket, 1, now)}
+}
+
+// bucketExpire is how long the storage has to keep bucket: until it has
+// refilled, or until its debt is repaid and it has refilled after that.
+func bucketExpire(bucket *TokenBucket, now time.Time) time.Duration {
+	expire := bucket.RefillTime()
+	if drain := bucket.WaitTime(bucket.Capacity(), now); drain > expire {
+		expire = drain
+	}
+	return expire
+}
+
+// checkChargeArgs is checkPostArgs without the limit on count, since a
+// charge may exceed the capacity of the bucket.
+func checkChargeArgs(key string, count, limit, burst int64, duration time.Duration) error {
+	if err := checkPostArgs(key, 1, limit, burst, duration); err != nil {
+		return err
+	}
+	if count <= 0 {
+		return ErrCountZero
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package ratelimit
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCharge(t *testing.T) {
+	storage := NewDummyStorage()
+	clock := NewFakeClock(time.Now())
+	limiter := NewSingleThreadLimiter(storage)
+	limiter.SetClock(clock)
+	limiter.Start()
+	defer limiter.Stop()
+	ctx := context.Background()
+	if _, err := limiter.Check(ctx, "testkey1", 10, time.Second*10, Options{}); err != nil {
+		t.Error("A new key should pass", err)
+	}
+	// 25 bytes sent against 10 per 10s
+	result, err := limiter.Charge(ctx, "testkey1", 25, 10, time.Second*10, Options{})
+	if err != nil || result.Used != 25 || result.Remaining != 0 {
+		t.Error("Charges should exceed the limit", result, err)
+	}
+	if result.RetryAfter != time.Second*16 {
+		t.Error("The debt should be repaid before the next token", result.RetryAfter)
+	}
+	result, err = limiter.Check(ctx, "testkey1", 10, time.Second*10, Options{})
+	if err != ErrLimitReached || result.RetryAfter != time.Second*16 {
+		t.Error("Check should fail while in debt", result, err)
+	}
+	clock.Advance(time.Second * 15)
+	if _, err := limiter.Post("testkey1", 1, 10, time.Second*10); err != ErrLimitReached {
+		t.Error("Post should fail while in debt", err)
+	}
+	clock.Advance(time.Second)
+	if _, err := limiter.Post("testkey1", 1, 10, time.Second*10); err != nil {
+		t.Error("Post should pass once the debt is repaid", err)
+	}
+
+	if _, err := limiter.Charge(ctx, "testkey1", 0, 10, time.Second*10, Options{}); err != ErrCountZero {
+		t.Error("Count should be required", err)
+	}
+	gcra := Options{Algorithm: AlgorithmGCRA}
+	if _, err := limiter.Charge(ctx, "testkey2", 1, 10, time.Second*10, gcra); err != ErrDebtAlgorithm {
+		t.Error("Only token buckets should be charged", err)
+	}
+}
+
+// The storage keeps a bucket until its debt is repaid, or it would be
+// forgiven when its refill time is up.
+func TestChargeExpire(t *testing.T) {
+	now := time.Now()
+	bucket := NewTokenBucketAt(10, time.Second, now)
+	bucket.ChargeAt(30, now)
+	if expire := bucketExpire(bucket, now); expire != time.Second*3 {
+		t.Error("The bucket should be kept until it refills", expire)
+	}
+	if expire := bucketExpire(NewTokenBucketAt(10, time.Second, now), now); expire != time.Second {
+		t.Error("Buckets not in debt should be kept for their refill time", expire)
+	}
+	// Metering bytes charges far more than the limit, so debts can last
+	// longer than memcache expirations go
+	bucket = NewTokenBucketAt(1, time.Second, now)
+	bucket.ChargeAt(4000000000, now)
+	if seconds := expireSeconds(bucketExpire(bucket, now)); seconds != math.MaxInt32 {
+		t.Error("Large debts should be kept as long as memcache can", seconds)
+	}
+	if seconds := expireSeconds(math.MaxInt64); seconds != math.MaxInt32 {
+		t.Error("The longest expiration should not overflow", seconds)
+	}
+}
+
+func TestHttpServerCharge(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	httpServer := NewHttpServer(NewShardedLimiter(NewDummyStorage(), 1), logger)
+	post := func(path, query string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("POST", path+"?"+query, nil)
+		httpServer.ServeHTTP(recorder, request)
+		return recorder
+	}
+	if recorder := post("/check", "key=testkey1&limit=10&duration=1h"); recorder.Code != http.StatusOK {
+		t.Error("A new key should pass", recorder.Code)
+	}
+	recorder := post("/charge", "key=testkey1&count=15&limit=10&duration=1h")
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "15\n" {
+		t.Error("Charges should exceed the limit", recorder.Code, recorder.Body.String())
+	}
+	if recorder.Header().Get("Retry-After") == "" {
+		t.Error("Retry-After should be set while in debt", recorder.Header())
+	}
+	recorder = post("/check", "key=testkey1&limit=10&duration=1h")
+	if recorder.Code != http.StatusMethodNotAllowed || recorder.Header().Get("Retry-After") == "" {
+		t.Error("Check should fail while in debt", recorder.Code, recorder.Header())
+	}
+	if recorder := post("/charge", "key=testkey1&limit=10&duration=1h"); recorder.Code != http.StatusBadRequest {
+		t.Error("Count should be required", recorder.Code)
+	}
+}
@@ -0,0 +1,194 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+)
+
+// localWindowStart is windowStart with windows aligned to the wall clock
+// of location instead of the Unix epoch, so that daily windows start at
+// its midnight. A nil location is UTC. Windows follow the offset of
+// location at now, so they shift along with daylight saving time.
+func localWindowStart(now time.Time, duration time.Duration, location *time.Location) time.Time {
+	if location == nil {
+		return windowStart(now, duration)
+	}
+	_, offset := now.In(location).Zone()
+	shift := time.Duration(offset) * time.Second
+	return windowStart(now.Add(shift), duration).Add(-shift)
+}
+
+// fixedWindow is the state of a key under the fixed window counter.
+type fixedWindow struct {
+	limit    int64
+	duration time.Duration
+	start    time.Time
+	count    int64
+}
+
+func (w *fixedWindow) end() time.Time {
+	return w.start.Add(w.duration)
+}
+
+// migrate changes the limit and duration of w as of now. Its count is
+// carried into the window of the new duration that now is in, or its
+// share of the limit with Rescale, rounded up.
+func (w *fixedWindow) migrate(limit int64, duration time.Duration, migration Migration, location *time.Location, now time.Time) {
+	if migration == Rescale {
+		w.count = int64(mulDiv(uint64(w.count), uint64(limit), uint64(w.limit), true))
+	}
+	w.limit, w.duration = limit, duration
+	w.start = localWindowStart(now, duration, location)
+}
+
+// result describes w at now for a caller that wants count tokens.
+func (w *fixedWindow) result(count int64, now time.Time) Result {
+	remaining := w.limit - w.count
+	if remaining < 0 {
+		remaining = 0
+	}
+	var retryAfter time.Duration
+	if w.count+count > w.limit {
+		retryAfter = w.end().Sub(now)
+	}
+	return Result{
+		Used:       w.count,
+		Remaining:  remaining,
+		Limit:      w.limit,
+		Window:     w.duration,
+		Reset:      w.end(),
+		RetryAfter: retryAfter,
+	}
+}
+
+// fixedWindowAlgorithm counts the tokens of a key in windows of duration
+// that start at fixed boundaries, such as every minute on the minute or
+// every day at midnight, and resets the count when a new window starts.
+// Windows are aligned to the Unix epoch, or to the wall clock of the
+// location of the settings.
+type fixedWindowAlgorithm struct{}
+
+func loadFixedWindow(ctx context.Context, s CounterStorage, key string, limit int64, duration time.Duration, location *time.Location, now time.Time) (*fixedWindow, error) {
+	start := localWindowStart(now, duration, location)
+	counters, err := s.GetCounters(ctx, key, []time.Time{start})
+	if err != nil {
+		return nil, err
+	}
+	w := &fixedWindow{limit: limit, duration: duration, start: start}
+	if counters != nil {
+		w.count = counters.Counts[0]
+	}
+	return w, nil
+}
+
+// loadStoredFixedWindow is loadFixedWindow with the limit and duration key
+// was last posted with.
+func loadStoredFixedWindow(ctx context.Context, s CounterStorage, key string, location *time.Location, now time.Time) (*fixedWindow, error) {
+	counters, err := s.GetCounters(ctx, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	if counters == nil {
+		return nil, ErrNotFound
+	}
+	return loadFixedWindow(ctx, s, key, counters.Limit, counters.Duration, location, now)
+}
+
+func (fixedWindowAlgorithm) post(storage Storage, settings settings, now time.Time, req request, peek bool) response {
+	s, err := counterStorage(storage)
+	if err != nil {
+		return response{err: err}
+	}
+	key := stateKey(AlgorithmFixedWindow, req.key)
+	w, err := loadStoredFixedWindow(req.ctx, s, key, settings.location, now)
+	if err == ErrNotFound {
+		w, err = &fixedWindow{limit: req.limit, duration: req.duration, start: localWindowStart(now, req.duration, settings.location)}, nil
+	}
+	if err != nil {
+		return response{err: err}
+	}
+	// Windows of another duration start elsewhere, so the count of a key
+	// whose limit or duration changed is carried into a new one
+	var stale []time.Time
+	if w.limit != req.limit || w.duration != req.duration {
+		stale = []time.Time{w.start}
+		w.migrate(req.limit, req.duration, settings.migration, settings.location, now)
+		stale = append(stale, w.start)
+	}
+	if w.count+req.count > w.limit {
+		return response{result: w.result(req.count, now), err: ErrLimitReached}
+	}
+	if peek {
+		w.count += req.count
+		return response{result: w.result(0, now)}
+	}
+	delta := req.count
+	if stale != nil {
+		// The carried count replaces the windows of both durations
+		err = s.DeleteCounters(req.ctx, key, stale)
+		if err != nil {
+			return response{err: err}
+		}
+		delta += w.count
+	}
+	// The count is of no use once its window is over
+	count, err := s.IncrCounter(req.ctx, key, w.start, delta, w.limit, w.duration, w.end().Sub(now))
+	if err != nil {
+		return response{err: err}
+	}
+	if count > w.limit {
+		// Other posts took the tokens since the count was read, so the
+		// increment is taken back
+		w.count, err = s.IncrCounter(req.ctx, key, w.start, -req.count, w.limit, w.duration, w.end().Sub(now))
+		if err != nil {
+			return response{err: err}
+		}
+		return response{result: w.result(req.count, now), err: ErrLimitReached}
+	}
+	w.count = count
+	return response{result: w.result(0, now)}
+}
+
+func (fixedWindowAlgorithm) get(storage Storage, settings settings, now time.Time, req request) response {
+	s, err := counterStorage(storage)
+	if err != nil {
+		return response{err: err}
+	}
+	key := stateKey(AlgorithmFixedWindow, req.key)
+	w, err := loadStoredFixedWindow(req.ctx, s, key, settings.location, now)
+	if err != nil {
+		return response{err: err}
+	}
+	return response{result: w.result(req.count, now)}
+}
+
+func (fixedWindowAlgorithm) refund(storage Storage, settings settings, now time.Time, req request) response {
+	s, err := counterStorage(storage)
+	if err != nil {
+		return response{err: err}
+	}
+	key := stateKey(AlgorithmFixedWindow, req.key)
+	w, err := loadStoredFixedWindow(req.ctx, s, key, settings.location, now)
+	if err != nil {
+		return response{err: err}
+	}
+	w.count, err = s.IncrCounter(req.ctx, key, w.start, -req.count, w.limit, w.duration, w.end().Sub(now))
+	if err != nil {
+		return response{err: err}
+	}
+	return response{result: w.result(0, now)}
+}
+
+func (fixedWindowAlgorithm) remove(storage Storage, settings settings, now time.Time, req request) response {
+	s, err := counterStorage(storage)
+	if err != nil {
+		return response{err: err}
+	}
+	key := stateKey(AlgorithmFixedWindow, req.key)
+	counters, err := s.GetCounters(req.ctx, key, nil)
+	if err != nil || counters == nil {
+		return response{err: err}
+	}
+	start := localWindowStart(now, counters.Duration, settings.location)
+	return response{err: s.DeleteCounters(req.ctx, key, []time.Time{start})}
+}
@@ -0,0 +1,129 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestFixedWindow(t *testing.T) {
+	storage := NewDummyStorage()
+	clock := NewFakeClock(time.Date(2017, 7, 14, 2, 40, 30, 0, time.UTC))
+	limiter := NewSingleThreadLimiter(storage)
+	limiter.SetClock(clock)
+	limiter.Start()
+	defer limiter.Stop()
+	ctx := context.Background()
+	opts := Options{Algorithm: AlgorithmFixedWindow}
+	result, err := limiter.PostContext(ctx, "testkey1", 10, 10, time.Minute, opts)
+	if err != nil || result.Used != 10 {
+		t.Error("Used should be 10", result, err)
+	}
+	if !result.Reset.Equal(time.Date(2017, 7, 14, 2, 41, 0, 0, time.UTC)) {
+		t.Error("Reset should be the next minute on the minute", result.Reset)
+	}
+	result, err = limiter.PostContext(ctx, "testkey1", 1, 10, time.Minute, opts)
+	if err != ErrLimitReached || result.RetryAfter != time.Second*30 {
+		t.Error("Limit should be reached until the window ends", result, err)
+	}
+	clock.Advance(time.Second * 30)
+	result, err = limiter.PostContext(ctx, "testkey1", 1, 10, time.Minute, opts)
+	if err != nil || result.Used != 1 {
+		t.Error("A new window should start from zero", result, err)
+	}
+	result, err = limiter.RefundContext(ctx, "testkey1", 5, opts)
+	if err != nil || result.Used != 0 {
+		t.Error("Usage should not drop below zero", result, err)
+	}
+	if err := limiter.DeleteContext(ctx, "testkey1", opts); err != nil {
+		t.Error(err)
+	}
+	if _, err := limiter.GetContext(ctx, "testkey1", opts); err != ErrNotFound {
+		t.Error("Key should be deleted", err)
+	}
+}
+
+func TestFixedWindowLocation(t *testing.T) {
+	location := time.FixedZone("UTC-5", -5*60*60)
+	storage := NewDummyStorage()
+	clock := NewFakeClock(time.Date(2017, 7, 14, 23, 0, 0, 0, location))
+	limiter := NewShardedLimiter(storage, 1)
+	limiter.SetClock(clock)
+	ctx := context.Background()
+	opts := Options{Algorithm: AlgorithmFixedWindow}
+	day := time.Hour * 24
+
+	result, _ := limiter.PostContext(ctx, "epoch", 1, 10, day, opts)
+	if !result.Reset.Equal(time.Date(2017, 7, 16, 0, 0, 0, 0, time.UTC)) {
+		t.Error("Daily windows should end at midnight UTC", result.Reset)
+	}
+	limiter.SetLocation(location)
+	result, _ = limiter.PostContext(ctx, "local", 1, 10, day, opts)
+	if !result.Reset.Equal(time.Date(2017, 7, 15, 0, 0, 0, 0, location)) {
+		t.Error("Daily windows should end at local midnight", result.Reset)
+	}
+	clock.Advance(time.Hour)
+	result, err := limiter.GetContext(ctx, "local", opts)
+	if err != nil || result.Used != 0 {
+		t.Error("A new window should start at local midnight", result, err)
+	}
+}
+
+func TestFixedWindowDurationChange(t *testing.T) {
+	storage := NewDummyStorage()
+	clock := NewFakeClock(time.Date(2017, 7, 14, 2, 0, 0, 0, time.UTC))
+	limiter := NewShardedLimiter(storage, 1)
+	limiter.SetClock(clock)
+	ctx := context.Background()
+	opts := Options{Algorithm: AlgorithmFixedWindow}
+	limiter.PostContext(ctx, "testkey1", 5, 5, time.Hour, opts)
+	clock.Advance(time.Minute)
+	result, err := limiter.PostContext(ctx, "testkey1", 1, 5, time.Minute*59, opts)
+	if err != ErrLimitReached || result.Used != 5 {
+		t.Error("Another duration should not start from zero", result, err)
+	}
+	result, err = limiter.PostContext(ctx, "testkey1", 1, 10, time.Minute*59, opts)
+	if err != nil || result.Used != 6 {
+		t.Error("The count should be carried into the new window", result, err)
+	}
+	limiter.SetMigration(Rescale)
+	result, err = limiter.PostContext(ctx, "testkey1", 1, 20, time.Hour, opts)
+	if err != nil || result.Used != 13 {
+		t.Error("Rescale should keep the share of the limit", result, err)
+	}
+}
+
+// racingCounterStorage lets another instance post count tokens between
+// the read and the increment of the next post.
+type racingCounterStorage struct {
+	*DummyStorage
+	count int64
+	raced bool
+}
+
+func (s *racingCounterStorage) IncrCounter(ctx context.Context, key string, start time.Time, delta, limit int64, duration, expire time.Duration) (int64, error) {
+	if !s.raced {
+		s.raced = true
+		s.DummyStorage.IncrCounter(ctx, key, start, s.count, limit, duration, expire)
+	}
+	return s.DummyStorage.IncrCounter(ctx, key, start, delta, limit, duration, expire)
+}
+
+func TestFixedWindowConcurrentIncrement(t *testing.T) {
+	storage := &racingCounterStorage{DummyStorage: NewDummyStorage(), count: 3, raced: true}
+	clock := NewFakeClock(time.Date(2017, 7, 14, 2, 0, 0, 0, time.UTC))
+	limiter := NewShardedLimiter(storage, 1)
+	limiter.SetClock(clock)
+	ctx := context.Background()
+	opts := Options{Algorithm: AlgorithmFixedWindow}
+	limiter.PostContext(ctx, "testkey1", 1, 5, time.Minute, opts)
+	storage.raced = false
+	result, err := limiter.PostContext(ctx, "testkey1", 2, 5, time.Minute, opts)
+	if err != ErrLimitReached || result.Used != 4 {
+		t.Error("An increment over the limit should be taken back", result, err)
+	}
+	result, err = limiter.PostContext(ctx, "testkey1", 1, 5, time.Minute, opts)
+	if err != nil || result.Used != 5 {
+		t.Error("Post should pass on top of the other instance", result, err)
+	}
+}
@@ -0,0 +1,234 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/bits"
+	"time"
+)
+
+// GCRAState is what GCRA keeps per key. Limit and Duration are kept with
+// the TAT so that the usage can be read back without them.
+type GCRAState struct {
+	TAT      time.Time
+	Limit    int64
+	Duration time.Duration
+}
+
+// GCRAStorage is implemented by the storages that can keep the state of
+// GCRA. Its Get methods return nil for keys without a state.
+type GCRAStorage interface {
+	GetGCRA(ctx context.Context, key string) (*GCRAState, error)
+	// CompareAndSetGCRA replaces the state of key with state, in a single
+	// step, as long as it still is old, nil for none. It reports whether
+	// it did, so that instances sharing the storage never both update the
+	// state they read.
+	CompareAndSetGCRA(ctx context.Context, key string, old, state *GCRAState, expire time.Duration) (bool, error)
+	DeleteGCRA(ctx context.Context, key string) error
+}
+
+// String encodes state as the single value the network storages keep, and
+// compare.
+func (state *GCRAState) String() string {
+	return fmt.Sprintf("%d %d %d", state.TAT.UnixNano(), state.Limit, int64(state.Duration))
+}
+
+func parseGCRAState(value string) (*GCRAState, error) {
+	var tat, limit, duration int64
+	_, err := fmt.Sscanf(value, "%d %d %d", &tat, &limit, &duration)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid GCRA state '%s'", value)
+	}
+	return &GCRAState{time.Unix(0, tat), limit, time.Duration(duration)}, nil
+}
+
+// maxInterval keeps intervals of absurd counts from overflowing when
+// they are added to a debt.
+const maxInterval = time.Duration(1 << 62)
+
+// interval is how far count tokens move the TAT.
+func (state *GCRAState) interval(count int64) time.Duration {
+	interval := mulDiv(uint64(count), uint64(state.Duration), uint64(state.Limit), false)
+	if interval > uint64(maxInterval) {
+		return maxInterval
+	}
+	return time.Duration(interval)
+}
+
+// debt is how long after now the usage drains to zero.
+func (state *GCRAState) debt(now time.Time) time.Duration {
+	if state.TAT.After(now) {
+		return state.TAT.Sub(now)
+	}
+	return 0
+}
+
+// migrate changes the limit and duration of state as of now, keeping its
+// usage according to migration.
+// The new debt is rounded down, since rounding it up by a nanosecond would
+// already report one more token used.
+func (state *GCRAState) migrate(limit int64, duration time.Duration, migration Migration, now time.Time) {
+	debt := uint64(state.debt(now))
+	if migration == Rescale {
+		debt = mulDiv(debt, uint64(duration), uint64(state.Duration), false)
+	} else {
+		// The tokens used, rounded up to the units of the token bucket
+		used := mulDiv(debt, uint64(state.Limit)*uint64(Token), uint64(state.Duration), true)
+		debt = mulDiv(used, uint64(duration), uint64(limit)*uint64(Token), false)
+	}
+	if debt > uint64(maxInterval) {
+		debt = uint64(maxInterval)
+	}
+	state.TAT = now.Add(time.Duration(debt))
+	state.Limit = limit
+	state.Duration = duration
+}
+
+// result describes state at now for a caller that wants count tokens.
+func (state *GCRAState) result(count int64, now time.Time) Result {
+	debt := state.debt(now)
+	used := int64(mulDiv(uint64(debt), uint64(state.Limit), uint64(state.Duration), true))
+	remaining := state.Limit - used
+	if remaining < 0 {
+		remaining = 0
+	}
+	var retryAfter time.Duration
+	if wait := debt + state.interval(count) - state.Duration; wait > 0 {
+		retryAfter = wait
+	}
+	return Result{
+		Used:       used,
+		Remaining:  remaining,
+		Limit:      state.Limit,
+		Window:     state.Duration,
+		Reset:      now.Add(debt),
+		RetryAfter: retryAfter,
+	}
+}
+
+// mulDiv returns a*b/c rounded down, or up if ceil is set, without
+// overflowing on the intermediate product. Results that do not fit in 64
+// bits are capped.
+func mulDiv(a, b, c uint64, ceil bool) uint64 {
+	hi, lo := bits.Mul64(a, b)
+	if hi >= c {
+		return math.MaxUint64
+	}
+	quo, rem := bits.Div64(hi, lo, c)
+	if ceil && rem > 0 {
+		quo++
+	}
+	return quo
+}
+
+// gcraAlgorithm is the generic cell rate algorithm. Instead of a bucket it
+// keeps the theoretical arrival time (TAT) of a key: the time at which its
+// usage will have drained to zero. Every token moves the TAT forward by
+// duration/limit and a request passes as long as the TAT stays within
+// duration of now. All arithmetic is done in whole nanoseconds, so its
+// retry-after values are exact.
+type gcraAlgorithm struct{}
+
+func gcraStorage(storage Storage) (GCRAStorage, error) {
+	s, ok := storage.(GCRAStorage)
+	if !ok {
+		return nil, ErrAlgorithmNoStorage
+	}
+	return s, nil
+}
+
+// updateGCRA reads the state of key, nil for none, and writes back the
+// one that update returns along with its response, unless that is nil.
+// If another instance sharing the storage changed the state in the
+// meantime, it starts over with the new one.
+func updateGCRA(ctx context.Context, s GCRAStorage, key string, update func(state *GCRAState) (*GCRAState, response)) response {
+	for {
+		state, err := s.GetGCRA(ctx, key)
+		if err != nil {
+			return response{err: err}
+		}
+		var copied *GCRAState
+		if state != nil {
+			// update may change the state it is given
+			c := *state
+			copied = &c
+		}
+		next, res := update(copied)
+		if next == nil {
+			return res
+		}
+		ok, err := s.CompareAndSetGCRA(ctx, key, state, next, next.Duration)
+		if err != nil {
+			return response{err: err}
+		}
+		if ok {
+			return res
+		}
+	}
+}
+
+func (gcraAlgorithm) post(storage Storage, settings settings, now time.Time, req request, peek bool) response {
+	s, err := gcraStorage(storage)
+	if err != nil {
+		return response{err: err}
+	}
+	return updateGCRA(req.ctx, s, req.key, func(state *GCRAState) (*GCRAState, response) {
+		if state == nil {
+			state = &GCRAState{now, req.limit, req.duration}
+		} else if state.Limit != req.limit || state.Duration != req.duration {
+			state.migrate(req.limit, req.duration, settings.migration, now)
+		}
+
+		debt := state.debt(now) + state.interval(req.count)
+		if debt > state.Duration {
+			return nil, response{result: state.result(req.count, now), err: ErrLimitReached}
+		}
+		next := &GCRAState{now.Add(debt), state.Limit, state.Duration}
+		if peek {
+			return nil, response{result: next.result(0, now)}
+		}
+		return next, response{result: next.result(0, now)}
+	})
+}
+
+func (gcraAlgorithm) get(storage Storage, _ settings, now time.Time, req request) response {
+	s, err := gcraStorage(storage)
+	if err != nil {
+		return response{err: err}
+	}
+	state, err := s.GetGCRA(req.ctx, req.key)
+	if err != nil {
+		return response{err: err}
+	}
+	if state == nil {
+		return response{err: ErrNotFound}
+	}
+	return response{result: state.result(req.count, now)}
+}
+
+func (gcraAlgorithm) refund(storage Storage, _ settings, now time.Time, req request) response {
+	s, err := gcraStorage(storage)
+	if err != nil {
+		return response{err: err}
+	}
+	return updateGCRA(req.ctx, s, req.key, func(state *GCRAState) (*GCRAState, response) {
+		if state == nil {
+			return nil, response{err: ErrNotFound}
+		}
+		debt := state.debt(now) - state.interval(req.count)
+		if debt < 0 {
+			debt = 0
+		}
+		next := &GCRAState{now.Add(debt), state.Limit, state.Duration}
+		return next, response{result: next.result(0, now)}
+	})
+}
+
+func (gcraAlgorithm) remove(storage Storage, _ settings, _ time.Time, req request) response {
+	s, err := gcraStorage(storage)
+	if err != nil {
+		return response{err: err}
+	}
+	return response{err: s.DeleteGCRA(req.ctx, req.key)}
+}
@@ -0,0 +1,244 @@
+package ratelimit
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestGCRA(t *testing.T) {
+	storage := NewDummyStorage()
+	clock := NewFakeClock(time.Now())
+	limiter := NewSingleThreadLimiter(storage)
+	limiter.SetClock(clock)
+	limiter.Start()
+	defer limiter.Stop()
+	ctx := context.Background()
+	opts := Options{Algorithm: AlgorithmGCRA}
+	duration := time.Second * 3
+	for i := int64(1); i <= 3; i++ {
+		result, err := limiter.PostContext(ctx, "testkey1", 1, 3, duration, opts)
+		if err != nil {
+			t.Error(err)
+		}
+		if result.Used != i || result.Remaining != 3-i {
+			t.Error("Used should be", i, result)
+		}
+	}
+	result, err := limiter.PostContext(ctx, "testkey1", 1, 3, duration, opts)
+	if err != ErrLimitReached {
+		t.Error("Limit should be reached", err)
+	}
+	if result.RetryAfter != time.Second {
+		t.Error("RetryAfter should be exactly 1s", result.RetryAfter)
+	}
+
+	clock.Advance(time.Second - 1)
+	_, err = limiter.PostContext(ctx, "testkey1", 1, 3, duration, opts)
+	if err != ErrLimitReached {
+		t.Error("Limit should still be reached", err)
+	}
+	clock.Advance(1)
+	result, err = limiter.PostContext(ctx, "testkey1", 1, 3, duration, opts)
+	if err != nil || result.Used != 3 {
+		t.Error("Post should pass right at RetryAfter", result, err)
+	}
+	if !result.Reset.Equal(clock.Now().Add(duration)) {
+		t.Error("Reset should be when the usage drains", result.Reset)
+	}
+
+	if bucket, _ := storage.Get(context.Background(), "testkey1"); bucket != nil {
+		t.Error("GCRA should not keep a bucket", bucket)
+	}
+	result, err = limiter.GetResult(ctx, "testkey1", 1, opts)
+	if err != nil || result.Used != 3 || result.RetryAfter != time.Second {
+		t.Error("Get should report the usage", result, err)
+	}
+	_, err = limiter.GetResult(context.Background(), "testkey1", 1, Options{})
+	if err != ErrNotFound {
+		t.Error("The token bucket of the key should not exist", err)
+	}
+}
+
+func TestGCRARefundAndDelete(t *testing.T) {
+	storage := NewDummyStorage()
+	clock := NewFakeClock(time.Now())
+	limiter := NewShardedLimiter(storage, 4)
+	limiter.SetClock(clock)
+	ctx := context.Background()
+	opts := Options{Algorithm: AlgorithmGCRA}
+	duration := time.Second * 10
+	limiter.PostContext(ctx, "testkey1", 10, 10, duration, opts)
+	result, err := limiter.RefundContext(ctx, "testkey1", 4, opts)
+	if err != nil || result.Used != 6 {
+		t.Error("Used should be 6", result, err)
+	}
+	result, err = limiter.Peek(ctx, "testkey1", 4, 10, duration, opts)
+	if err != nil || result.Used != 10 {
+		t.Error("Peek should see 10 used", result, err)
+	}
+	result, _ = limiter.GetResult(ctx, "testkey1", 1, opts)
+	if result.Used != 6 {
+		t.Error("Peek should not consume", result)
+	}
+	if err := limiter.DeleteContext(ctx, "testkey1", opts); err != nil {
+		t.Error(err)
+	}
+	if _, err := limiter.GetContext(ctx, "testkey1", opts); err != ErrNotFound {
+		t.Error("Key should be deleted", err)
+	}
+}
+
+func TestGCRAMigrate(t *testing.T) {
+	now := time.Now()
+	state := &GCRAState{now.Add(time.Second * 5), 10, time.Second * 10}
+	state.migrate(20, time.Second*10, CarryOver, now)
+	if result := state.result(0, now); result.Used != 5 {
+		t.Error("Carried over usage should be 5", result)
+	}
+	state = &GCRAState{now.Add(time.Second * 5), 10, time.Second * 10}
+	state.migrate(20, time.Second*10, Rescale, now)
+	if result := state.result(0, now); result.Used != 10 {
+		t.Error("Rescaled usage should be 10", result)
+	}
+}
+
+func TestGCRAMigrateExact(t *testing.T) {
+	now := time.Now()
+	// A third of a token is not a whole number of nanoseconds
+	state := &GCRAState{now.Add(time.Second * 10), 3, time.Second * 10}
+	state.migrate(7, time.Second, CarryOver, now)
+	if result := state.result(0, now); result.Used != 3 {
+		t.Error("Carried over usage should be exactly 3", result)
+	}
+	state = &GCRAState{now.Add(time.Second * 10), 3, time.Second * 10}
+	state.migrate(7, time.Second*3, Rescale, now)
+	if result := state.result(0, now); result.Used != 7 {
+		t.Error("Rescaled usage should be exactly 7", result)
+	}
+}
+
+// racingGCRAStorage lets another instance consume count tokens from the
+// state of every key right before the first update of this instance.
+type racingGCRAStorage struct {
+	*DummyStorage
+	count int64
+	raced bool
+}
+
+func (s *racingGCRAStorage) CompareAndSetGCRA(ctx context.Context, key string, old, state *GCRAState, expire time.Duration) (bool, error) {
+	if !s.raced {
+		s.raced = true
+		other := &GCRAState{old.TAT.Add(old.interval(s.count)), old.Limit, old.Duration}
+		s.DummyStorage.CompareAndSetGCRA(ctx, key, old, other, expire)
+	}
+	return s.DummyStorage.CompareAndSetGCRA(ctx, key, old, state, expire)
+}
+
+func TestGCRAConcurrentUpdate(t *testing.T) {
+	storage := &racingGCRAStorage{DummyStorage: NewDummyStorage(), count: 2, raced: true}
+	clock := NewFakeClock(time.Now())
+	limiter := NewShardedLimiter(storage, 1)
+	limiter.SetClock(clock)
+	ctx := context.Background()
+	opts := Options{Algorithm: AlgorithmGCRA}
+	limiter.PostContext(ctx, "testkey1", 1, 4, time.Second*4, opts)
+	storage.raced = false
+	result, err := limiter.PostContext(ctx, "testkey1", 1, 4, time.Second*4, opts)
+	if err != nil || result.Used != 4 {
+		t.Error("Post should retry on top of the other update", result, err)
+	}
+	_, err = limiter.PostContext(ctx, "testkey1", 1, 4, time.Second*4, opts)
+	if err != ErrLimitReached {
+		t.Error("Limit should be reached", err)
+	}
+}
+
+func TestGCRAStateString(t *testing.T) {
+	state := &GCRAState{time.Unix(0, 1500000000123), 10, time.Minute}
+	parsed, err := parseGCRAState(state.String())
+	if err != nil {
+		t.Error(err)
+	}
+	if *parsed != *state {
+		t.Error("State should survive encoding", parsed)
+	}
+	if _, err := parseGCRAState("garbage"); err == nil {
+		t.Error("Garbage should not parse")
+	}
+}
+
+func TestPostMultiAlgorithms(t *testing.T) {
+	storage := NewDummyStorage()
+	limiter := NewSingleThreadLimiter(storage)
+	limiter.Start()
+	defer limiter.Stop()
+	duration := time.Second * 100
+	items := []PostItem{
+		{"testkey1", 2, 2, duration, AlgorithmGCRA, 0},
+		{"testkey1", 2, 2, duration, AlgorithmTokenBucket, 0},
+	}
+	results, err := limiter.PostMulti(context.Background(), items)
+	if err != nil || results[0].Used != 2 || results[1].Used != 2 {
+		t.Error("Algorithms should keep their own state", results, err)
+	}
+	_, err = limiter.PostMulti(context.Background(), []PostItem{
+		{"testkey2", 1, 2, duration, AlgorithmTokenBucket, 0},
+		{"testkey1", 1, 2, duration, AlgorithmGCRA, 0},
+	})
+	keyErr, ok := err.(*KeyError)
+	if !ok || keyErr.Key != "testkey1" || keyErr.Err != ErrLimitReached {
+		t.Error("Error should be ErrLimitReached for testkey1", err)
+	}
+	if _, err := limiter.Get("testkey2"); err != ErrNotFound {
+		t.Error("Nothing should be consumed", err)
+	}
+	_, err = limiter.PostMulti(context.Background(), []PostItem{{"testkey3", 1, 2, duration, "nope", 0}})
+	keyErr, ok = err.(*KeyError)
+	if !ok || keyErr.Err != ErrUnknownAlgorithm {
+		t.Error("Error should be ErrUnknownAlgorithm", err)
+	}
+}
+
+func TestHttpServerAlgorithm(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	storage := NewDummyStorage()
+	limiter := NewSingleThreadLimiter(storage)
+	limiter.Start()
+	defer limiter.Stop()
+	httpServer := NewHttpServer(limiter, logger)
+	registry, _ := NewPolicyRegistry([]Policy{{MatchPrefix, "gcra:", 2, time.Second * 100, AlgorithmGCRA, 0}})
+	httpServer.SetPolicies(registry, false)
+	serve := func(method, query string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest(method, "/?"+query, nil)
+		httpServer.ServeHTTP(recorder, request)
+		return recorder
+	}
+	if recorder := serve("POST", "key=gcra:1&count=2"); recorder.Code != http.StatusOK {
+		t.Error("Status code is not 200", recorder.Code)
+	}
+	if state, _ := storage.GetGCRA(context.Background(), "gcra:1"); state == nil {
+		t.Error("Policy algorithm should apply")
+	}
+	if recorder := serve("GET", "key=gcra:1"); recorder.Code != http.StatusOK {
+		t.Error("Get should use the policy algorithm", recorder.Code)
+	}
+	if recorder := serve("POST", "key=other&count=1&limit=2&duration=1s&algorithm=gcra"); recorder.Code != http.StatusOK {
+		t.Error("Status code is not 200", recorder.Code)
+	}
+	if state, _ := storage.GetGCRA(context.Background(), "other"); state == nil {
+		t.Error("Client algorithm should apply")
+	}
+	if recorder := serve("POST", "key=other&count=1&limit=2&duration=1s&algorithm=nope"); recorder.Code != http.StatusBadRequest {
+		t.Error("Unknown algorithms should be rejected", recorder.Code)
+	}
+	httpServer.SetPolicies(registry, true)
+	if recorder := serve("POST", "key=gcra:2&count=1&algorithm=tokenbucket"); recorder.Code != http.StatusBadRequest {
+		t.Error("Strict mode should reject client algorithms", recorder.Code)
+	}
+}
@@ -1,38 +1,111 @@
 package ratelimit
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
 type HttpServer struct {
 	limiter Limiter
 	logger  *log.Logger
+
+	// mu guards the settings below, which may change while serving
+	mu       sync.RWMutex
+	timeout  time.Duration
+	policies *PolicyRegistry
+	strict   bool
 }
 
 func NewHttpServer(limiter Limiter, logger *log.Logger) *HttpServer {
 	return &HttpServer{
-		limiter,
-		logger,
+		limiter: limiter,
+		logger:  logger,
 	}
 }
 
+// SetTimeout bounds how long a single request may spend waiting on the
+// limiter and the storage. Zero, the default, means no bound other than
+// the client's own connection.
+func (s *HttpServer) SetTimeout(timeout time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.timeout = timeout
+}
+
+// SetPolicies lets clients leave out the limit and duration of keys that
+// have a policy. In strict mode clients cannot send them at all, and keys
+// without a policy are rejected. Requests already being served keep the
+// policies they started with.
+func (s *HttpServer) SetPolicies(policies *PolicyRegistry, strict bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.policies = policies
+	s.strict = strict
+}
+
 func (s *HttpServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	switch req.Method {
-	case "GET":
-		s.get(w, req)
-	case "POST":
-		s.post(w, req)
-	case "DELETE":
-		s.delete(w, req)
+	s.mu.RLock()
+	timeout := s.timeout
+	s.mu.RUnlock()
+	if timeout > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), timeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+	switch req.URL.Path {
+	case "/batch":
+		s.action(w, req, s.batch)
+	case "/refund":
+		s.action(w, req, s.refund)
+	case "/reserve":
+		s.action(w, req, s.reserve)
+	case "/commit":
+		s.action(w, req, s.commit)
+	case "/cancel":
+		s.action(w, req, s.cancel)
+	case "/quota":
+		s.quota(w, req)
+	case "/windows":
+		s.action(w, req, s.windows)
+	case "/acquire":
+		s.action(w, req, s.acquire)
+	case "/release":
+		s.action(w, req, s.release)
+	case "/check":
+		s.action(w, req, s.check)
+	case "/charge":
+		s.action(w, req, s.charge)
 	default:
+		switch req.Method {
+		case "GET":
+			s.get(w, req)
+		case "POST":
+			s.post(w, req)
+		case "DELETE":
+			s.delete(w, req)
+		default:
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// action serves the endpoints that only accept POST requests.
+func (s *HttpServer) action(w http.ResponseWriter, req *http.Request, handler http.HandlerFunc) {
+	if req.Method != "POST" {
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
 	}
+	handler(w, req)
 }
 
 func (s *HttpServer) get(w http.ResponseWriter, req *http.Request) {
@@ -43,62 +116,263 @@ func (s *HttpServer) get(w http.ResponseWriter, req *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	used, err := s.limiter.Get(key)
+	opts, err := s.keyOptions(req, key)
+	if err != nil {
+		s.logger.Println("HTTP GET 400", req.URL)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	count := int64(1)
+	if values.Get("count") != "" {
+		count, err = s.getRequiredKeyInt("count", values)
+		if err != nil {
+			s.logger.Println("HTTP GET 400", req.URL)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	result, err := s.limiter.GetResult(req.Context(), key, count, opts)
 	if err == ErrNotFound {
 		s.logger.Println("HTTP GET 404", key)
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
+	} else if isLimiterError(err) {
+		s.logger.Println("HTTP GET 400", req.URL)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if code, ok := interruptedCode(err); ok {
+		s.logger.Println("HTTP GET", code, key)
+		http.Error(w, http.StatusText(code), code)
+		return
 	} else if err != nil {
 		s.logger.Println("HTTP GET 500", key)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	s.logger.Println("HTTP GET 200", key, used)
-	fmt.Fprintln(w, used)
+	setRetryAfter(w, result.RetryAfter)
+	s.logger.Println("HTTP GET 200", key, result.Used)
+	writeResult(w, req, result)
 }
 
 func (s *HttpServer) post(w http.ResponseWriter, req *http.Request) {
 	values := req.URL.Query()
-	key, err := s.getRequiredKeyStr("key", values)
+	key, count, limit, duration, err := s.getPostArgs(values)
 	if err != nil {
 		s.logger.Println("HTTP POST 400", req.URL)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	count, err := s.getRequiredKeyInt("count", values)
+	opts, err := s.keyOptions(req, key)
 	if err != nil {
 		s.logger.Println("HTTP POST 400", req.URL)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	limit, err := s.getRequiredKeyInt("limit", values)
+	dryRun, err := s.getOptionalKeyBool("dryRun", values)
 	if err != nil {
 		s.logger.Println("HTTP POST 400", req.URL)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	duration, err := s.getRequiredKeyDuration("duration", values)
-	if err != nil {
+	var result Result
+	if dryRun {
+		result, err = s.limiter.Peek(req.Context(), key, count, limit, duration, opts)
+	} else if values.Get("maxWait") != "" {
+		var maxWait time.Duration
+		maxWait, err = s.getRequiredKeyDuration("maxWait", values)
+		if err == nil && maxWait <= 0 {
+			// A context that is done already would report any key as
+			// limited
+			err = errors.New("'maxWait' should be greater than zero")
+		}
+		if err != nil {
+			s.logger.Println("HTTP POST 400", req.URL)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		result, err = s.wait(req.Context(), maxWait, key, count, limit, duration, opts)
+	} else {
+		result, err = s.limiter.PostContext(req.Context(), key, count, limit, duration, opts)
+	}
+	if err == ErrLimitReached {
+		setRetryAfter(w, result.RetryAfter)
+		s.logger.Println("HTTP POST 405", key, count, limit, duration)
+		http.Error(w, err.Error(), http.StatusMethodNotAllowed)
+		return
+	} else if isLimiterError(err) {
 		s.logger.Println("HTTP POST 400", req.URL)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
+	} else if code, ok := interruptedCode(err); ok {
+		s.logger.Println("HTTP POST", code, req.URL)
+		http.Error(w, http.StatusText(code), code)
+		return
+	} else if err != nil {
+		s.logger.Println("HTTP POST 500", req.URL, err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	setDelay(w, result.Delay)
+	s.logger.Println("HTTP POST 200", key, count, limit, duration, result.Used)
+	writeResult(w, req, result)
+}
+
+// wait is the long-poll variant of post. It blocks for at most maxWait
+// until count tokens are available.
+func (s *HttpServer) wait(parent context.Context, maxWait time.Duration, key string, count, limit int64, duration time.Duration, opts Options) (Result, error) {
+	ctx, cancel := context.WithTimeout(parent, maxWait)
+	defer cancel()
+	result, err := s.limiter.Wait(ctx, key, count, limit, duration, opts)
+	if err == context.DeadlineExceeded && parent.Err() == nil {
+		// Only our own maxWait expired, which means the limit was reached
+		return result, ErrLimitReached
+	}
+	return result, err
+}
+
+// batch consumes several keys at once, all or nothing. Every key is
+// given with its own count, limit and duration, in the same order.
+func (s *HttpServer) batch(w http.ResponseWriter, req *http.Request) {
+	items, err := s.getBatchArgs(req.URL.Query())
+	if err != nil {
+		s.logger.Println("HTTP BATCH 400", req.URL)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	results, err := s.limiter.PostMulti(req.Context(), items)
+	cause := err
+	if keyErr, ok := err.(*KeyError); ok {
+		cause = keyErr.Err
+	}
+	if cause == ErrLimitReached {
+		s.logger.Println("HTTP BATCH 405", err.Error())
+		http.Error(w, err.Error(), http.StatusMethodNotAllowed)
+		return
+	} else if isLimiterError(cause) {
+		s.logger.Println("HTTP BATCH 400", req.URL)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if code, ok := interruptedCode(err); ok {
+		s.logger.Println("HTTP BATCH", code, req.URL)
+		http.Error(w, http.StatusText(code), code)
+		return
+	} else if err != nil {
+		s.logger.Println("HTTP BATCH 500", req.URL, err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.logger.Println("HTTP BATCH 200", req.URL.RawQuery)
+	if wantsJSON(req) {
+		rendered := make([]jsonResult, len(results))
+		for i, result := range results {
+			rendered[i] = newJSONResult(result)
+		}
+		writeJSON(w, rendered)
+		return
+	}
+	for i, result := range results {
+		if i > 0 {
+			fmt.Fprint(w, " ")
+		}
+		fmt.Fprint(w, result.Used)
+	}
+	fmt.Fprintln(w)
+}
+
+// windows consumes the tokens of a key from several windows at once, all or
+// nothing. Every window is given with its own limit and duration, in the
+// same order. The response describes the binding window and the
+// X-Ratelimit-Window header gives its position, starting at 0.
+func (s *HttpServer) windows(w http.ResponseWriter, req *http.Request) {
+	values := req.URL.Query()
+	key, count, windows, err := s.getWindowsArgs(values)
+	if err != nil {
+		s.logger.Println("HTTP WINDOWS 400", req.URL)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts, err := s.keyOptions(req, key)
+	if err != nil {
+		s.logger.Println("HTTP WINDOWS 400", req.URL)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	used, err := s.limiter.Post(key, count, limit, duration)
+	results, binding, err := s.limiter.PostWindows(req.Context(), key, count, windows, opts)
 	if err == ErrLimitReached {
-		s.logger.Println("HTTP POST 405", key, count, limit, values.Get("duration"))
+		setRetryAfter(w, results[binding].RetryAfter)
+		w.Header().Set("X-Ratelimit-Window", strconv.Itoa(binding))
+		s.logger.Println("HTTP WINDOWS 405", key, count, windows[binding].Limit, windows[binding].Duration)
 		http.Error(w, err.Error(), http.StatusMethodNotAllowed)
 		return
 	} else if isLimiterError(err) {
-		s.logger.Println("HTTP POST 400", req.URL)
+		s.logger.Println("HTTP WINDOWS 400", req.URL)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
+	} else if code, ok := interruptedCode(err); ok {
+		s.logger.Println("HTTP WINDOWS", code, req.URL)
+		http.Error(w, http.StatusText(code), code)
+		return
 	} else if err != nil {
-		s.logger.Println("HTTP POST 500", req.URL, err.Error())
+		s.logger.Println("HTTP WINDOWS 500", req.URL, err.Error())
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	s.logger.Println("HTTP POST 200", key, count, limit, values.Get("duration"), used)
-	fmt.Fprintln(w, used)
+	w.Header().Set("X-Ratelimit-Window", strconv.Itoa(binding))
+	s.logger.Println("HTTP WINDOWS 200", key, count, binding, results[binding].Used)
+	writeResult(w, req, results[binding])
+}
+
+// quota consumes tokens from a calendar quota on POST and reads its usage
+// on GET. Reset is when the next period starts.
+func (s *HttpServer) quota(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	values := req.URL.Query()
+	key, quota, err := s.getQuotaArgs(values)
+	if err != nil {
+		s.logger.Println("HTTP QUOTA 400", req.URL)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var result Result
+	if req.Method == "GET" {
+		result, err = s.limiter.GetQuota(req.Context(), key, quota)
+	} else {
+		var count int64
+		count, err = s.getRequiredKeyInt("count", values)
+		if err != nil {
+			s.logger.Println("HTTP QUOTA 400", req.URL)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		result, err = s.limiter.PostQuota(req.Context(), key, count, quota)
+	}
+	if err == ErrNotFound {
+		s.logger.Println("HTTP QUOTA 404", key)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err == ErrLimitReached {
+		setRetryAfter(w, result.RetryAfter)
+		s.logger.Println("HTTP QUOTA 405", key, quota.Limit, quota.Period)
+		http.Error(w, err.Error(), http.StatusMethodNotAllowed)
+		return
+	} else if isLimiterError(err) {
+		s.logger.Println("HTTP QUOTA 400", req.URL)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if code, ok := interruptedCode(err); ok {
+		s.logger.Println("HTTP QUOTA", code, req.URL)
+		http.Error(w, http.StatusText(code), code)
+		return
+	} else if err != nil {
+		s.logger.Println("HTTP QUOTA 500", req.URL, err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.logger.Println("HTTP QUOTA 200", req.Method, key, quota.Limit, quota.Period, result.Used)
+	writeResult(w, req, result)
 }
 
 func (s *HttpServer) delete(w http.ResponseWriter, req *http.Request) {
@@ -109,8 +383,18 @@ func (s *HttpServer) delete(w http.ResponseWriter, req *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	err = s.limiter.Delete(key)
+	opts, err := s.keyOptions(req, key)
 	if err != nil {
+		s.logger.Println("HTTP DELETE 400", req.URL)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = s.limiter.DeleteContext(req.Context(), key, opts)
+	if code, ok := interruptedCode(err); ok {
+		s.logger.Println("HTTP DELETE", code, req.URL)
+		http.Error(w, http.StatusText(code), code)
+		return
+	} else if err != nil {
 		s.logger.Println("HTTP DELETE 500", req.URL)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -119,6 +403,508 @@ func (s *HttpServer) delete(w http.ResponseWriter, req *http.Request) {
 	fmt.Fprint(w, "")
 }
 
+func (s *HttpServer) refund(w http.ResponseWriter, req *http.Request) {
+	values := req.URL.Query()
+	key, err := s.getRequiredKeyStr("key", values)
+	if err != nil {
+		s.logger.Println("HTTP REFUND 400", req.URL)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts, err := s.keyOptions(req, key)
+	if err != nil {
+		s.logger.Println("HTTP REFUND 400", req.URL)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	count, err := s.getRequiredKeyInt("count", values)
+	if err != nil {
+		s.logger.Println("HTTP REFUND 400", req.URL)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	result, err := s.limiter.RefundContext(req.Context(), key, count, opts)
+	if err == ErrNotFound {
+		s.logger.Println("HTTP REFUND 404", key)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if isLimiterError(err) {
+		s.logger.Println("HTTP REFUND 400", req.URL)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if code, ok := interruptedCode(err); ok {
+		s.logger.Println("HTTP REFUND", code, req.URL)
+		http.Error(w, http.StatusText(code), code)
+		return
+	} else if err != nil {
+		s.logger.Println("HTTP REFUND 500", req.URL, err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.logger.Println("HTTP REFUND 200", key, count, result.Used)
+	writeResult(w, req, result)
+}
+
+func (s *HttpServer) reserve(w http.ResponseWriter, req *http.Request) {
+	values := req.URL.Query()
+	key, count, limit, duration, err := s.getPostArgs(values)
+	if err != nil {
+		s.logger.Println("HTTP RESERVE 400", req.URL)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts, err := s.keyOptions(req, key)
+	if err != nil {
+		s.logger.Println("HTTP RESERVE 400", req.URL)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	reservation, err := s.limiter.Reserve(req.Context(), key, count, limit, duration, opts)
+	if err == ErrLimitReached {
+		s.logger.Println("HTTP RESERVE 405", key, count, limit, duration)
+		http.Error(w, err.Error(), http.StatusMethodNotAllowed)
+		return
+	} else if isLimiterError(err) {
+		s.logger.Println("HTTP RESERVE 400", req.URL)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if code, ok := interruptedCode(err); ok {
+		s.logger.Println("HTTP RESERVE", code, req.URL)
+		http.Error(w, http.StatusText(code), code)
+		return
+	} else if err != nil {
+		s.logger.Println("HTTP RESERVE 500", req.URL, err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.logger.Println("HTTP RESERVE 200", key, count, limit, duration, reservation.ID, reservation.Used)
+	fmt.Fprintln(w, reservation.ID, reservation.Used)
+}
+
+func (s *HttpServer) commit(w http.ResponseWriter, req *http.Request) {
+	id, err := s.getRequiredKeyStr("id", req.URL.Query())
+	if err != nil {
+		s.logger.Println("HTTP COMMIT 400", req.URL)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = s.limiter.Commit(id)
+	if err == ErrReservationNotFound {
+		s.logger.Println("HTTP COMMIT 404", id)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		s.logger.Println("HTTP COMMIT 500", id, err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.logger.Println("HTTP COMMIT 200", id)
+	fmt.Fprint(w, "")
+}
+
+func (s *HttpServer) cancel(w http.ResponseWriter, req *http.Request) {
+	id, err := s.getRequiredKeyStr("id", req.URL.Query())
+	if err != nil {
+		s.logger.Println("HTTP CANCEL 400", req.URL)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = s.limiter.Cancel(req.Context(), id)
+	if err == ErrReservationNotFound {
+		s.logger.Println("HTTP CANCEL 404", id)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if code, ok := interruptedCode(err); ok {
+		s.logger.Println("HTTP CANCEL", code, id)
+		http.Error(w, http.StatusText(code), code)
+		return
+	} else if err != nil {
+		s.logger.Println("HTTP CANCEL 500", id, err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.logger.Println("HTTP CANCEL 200", id)
+	fmt.Fprint(w, "")
+}
+
+// acquire takes a lease of one of the limit concurrent slots of key. The
+// duration is how long the lease lasts unless it is released.
+func (s *HttpServer) acquire(w http.ResponseWriter, req *http.Request) {
+	values := req.URL.Query()
+	key, err := s.getRequiredKeyStr("key", values)
+	if err != nil {
+		s.logger.Println("HTTP ACQUIRE 400", req.URL)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, ttl, err := s.getLimitArgs(key, values)
+	if err != nil {
+		s.logger.Println("HTTP ACQUIRE 400", req.URL)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	lease, result, err := s.limiter.Acquire(req.Context(), key, limit, ttl)
+	if err == ErrLimitReached {
+		setRetryAfter(w, result.RetryAfter)
+		s.logger.Println("HTTP ACQUIRE 405", key, limit, ttl)
+		http.Error(w, err.Error(), http.StatusMethodNotAllowed)
+		return
+	} else if isLimiterError(err) {
+		s.logger.Println("HTTP ACQUIRE 400", req.URL)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if code, ok := interruptedCode(err); ok {
+		s.logger.Println("HTTP ACQUIRE", code, req.URL)
+		http.Error(w, http.StatusText(code), code)
+		return
+	} else if err != nil {
+		s.logger.Println("HTTP ACQUIRE 500", req.URL, err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.logger.Println("HTTP ACQUIRE 200", key, limit, ttl, lease.ID, result.Used)
+	fmt.Fprintln(w, lease.ID, result.Used)
+}
+
+func (s *HttpServer) release(w http.ResponseWriter, req *http.Request) {
+	values := req.URL.Query()
+	key, err := s.getRequiredKeyStr("key", values)
+	if err != nil {
+		s.logger.Println("HTTP RELEASE 400", req.URL)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	id, err := s.getRequiredKeyStr("id", values)
+	if err != nil {
+		s.logger.Println("HTTP RELEASE 400", req.URL)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = s.limiter.Release(req.Context(), key, id)
+	if err == ErrLeaseNotFound {
+		s.logger.Println("HTTP RELEASE 404", key, id)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if isLimiterError(err) {
+		s.logger.Println("HTTP RELEASE 400", req.URL)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if code, ok := interruptedCode(err); ok {
+		s.logger.Println("HTTP RELEASE", code, req.URL)
+		http.Error(w, http.StatusText(code), code)
+		return
+	} else if err != nil {
+		s.logger.Println("HTTP RELEASE 500", req.URL, err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.logger.Println("HTTP RELEASE 200", key, id)
+	fmt.Fprint(w, "")
+}
+
+// check tells whether key has a token left, without consuming it. It
+// fails like post while the key is in debt.
+func (s *HttpServer) check(w http.ResponseWriter, req *http.Request) {
+	values := req.URL.Query()
+	key, err := s.getRequiredKeyStr("key", values)
+	if err != nil {
+		s.logger.Println("HTTP CHECK 400", req.URL)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts, err := s.keyOptions(req, key)
+	if err != nil {
+		s.logger.Println("HTTP CHECK 400", req.URL)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, duration, err := s.getLimitArgs(key, values)
+	if err != nil {
+		s.logger.Println("HTTP CHECK 400", req.URL)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	result, err := s.limiter.Check(req.Context(), key, limit, duration, opts)
+	if err == ErrLimitReached {
+		setRetryAfter(w, result.RetryAfter)
+		s.logger.Println("HTTP CHECK 405", key, limit, duration)
+		http.Error(w, err.Error(), http.StatusMethodNotAllowed)
+		return
+	} else if isLimiterError(err) {
+		s.logger.Println("HTTP CHECK 400", req.URL)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if code, ok := interruptedCode(err); ok {
+		s.logger.Println("HTTP CHECK", code, req.URL)
+		http.Error(w, http.StatusText(code), code)
+		return
+	} else if err != nil {
+		s.logger.Println("HTTP CHECK 500", req.URL, err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.logger.Println("HTTP CHECK 200", key, limit, duration, result.Used)
+	writeResult(w, req, result)
+}
+
+// charge records count tokens that were already spent, even past the
+// limit. Retry-After is set while the key is in debt.
+func (s *HttpServer) charge(w http.ResponseWriter, req *http.Request) {
+	values := req.URL.Query()
+	key, count, limit, duration, err := s.getPostArgs(values)
+	if err != nil {
+		s.logger.Println("HTTP CHARGE 400", req.URL)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts, err := s.keyOptions(req, key)
+	if err != nil {
+		s.logger.Println("HTTP CHARGE 400", req.URL)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	result, err := s.limiter.Charge(req.Context(), key, count, limit, duration, opts)
+	if isLimiterError(err) {
+		s.logger.Println("HTTP CHARGE 400", req.URL)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if code, ok := interruptedCode(err); ok {
+		s.logger.Println("HTTP CHARGE", code, req.URL)
+		http.Error(w, http.StatusText(code), code)
+		return
+	} else if err != nil {
+		s.logger.Println("HTTP CHARGE 500", req.URL, err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	setRetryAfter(w, result.RetryAfter)
+	s.logger.Println("HTTP CHARGE 200", key, count, limit, duration, result.Used)
+	writeResult(w, req, result)
+}
+
+// getPostArgs parses the arguments shared by every request that consumes
+// tokens.
+func (s *HttpServer) getPostArgs(values url.Values) (string, int64, int64, time.Duration, error) {
+	key, err := s.getRequiredKeyStr("key", values)
+	if err != nil {
+		return "", 0, 0, 0, err
+	}
+	count, err := s.getRequiredKeyInt("count", values)
+	if err != nil {
+		return "", 0, 0, 0, err
+	}
+	limit, duration, err := s.getLimitArgs(key, values)
+	if err != nil {
+		return "", 0, 0, 0, err
+	}
+	return key, count, limit, duration, nil
+}
+
+// getLimitArgs returns the limit and duration of key. The fields that the
+// client left out come from the policy of key.
+func (s *HttpServer) getLimitArgs(key string, values url.Values) (int64, time.Duration, error) {
+	s.mu.RLock()
+	policies, strict := s.policies, s.strict
+	s.mu.RUnlock()
+	var policy Policy
+	var ok bool
+	if policies != nil {
+		policy, ok = policies.Lookup(key)
+	}
+	if strict {
+		if values.Get("limit") != "" || values.Get("duration") != "" {
+			return 0, 0, ErrClientLimit
+		}
+		if !ok {
+			return 0, 0, ErrNoPolicy
+		}
+		return policy.Limit, policy.Duration, nil
+	}
+	limit, duration := policy.Limit, policy.Duration
+	var err error
+	if values.Get("limit") != "" || !ok {
+		limit, err = s.getRequiredKeyInt("limit", values)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	if values.Get("duration") != "" || !ok {
+		duration, err = s.getRequiredKeyDuration("duration", values)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	return limit, duration, nil
+}
+
+// getBatchArgs parses the repeated key, count, limit, duration, algorithm
+// and burst fields of a batch request into one item per key. All but key
+// and count may be left out altogether when the keys have policies.
+func (s *HttpServer) getBatchArgs(values url.Values) ([]PostItem, error) {
+	keys := values["key"]
+	if len(keys) == 0 {
+		return nil, errors.New("'key' field is missing")
+	}
+	for _, field := range []string{"count", "limit", "duration", "algorithm", "burst"} {
+		n := len(values[field])
+		if n != len(keys) && (n != 0 || field == "count") {
+			return nil, errors.New(fmt.Sprintf("'%s' field should be given once per key", field))
+		}
+	}
+	items := make([]PostItem, len(keys))
+	for i, key := range keys {
+		item := url.Values{}
+		item.Set("key", key)
+		for _, field := range []string{"count", "limit", "duration", "algorithm", "burst"} {
+			if len(values[field]) > 0 {
+				item.Set(field, values[field][i])
+			}
+		}
+		key, count, limit, duration, err := s.getPostArgs(item)
+		if err != nil {
+			return nil, err
+		}
+		algorithm, err := s.getAlgorithm(key, item)
+		if err != nil {
+			return nil, err
+		}
+		burst, err := s.getBurst(key, item)
+		if err != nil {
+			return nil, err
+		}
+		items[i] = PostItem{key, count, limit, duration, algorithm, burst}
+	}
+	return items, nil
+}
+
+// getWindowsArgs parses the key and count of a windows request and its
+// repeated limit and duration fields into one window per pair. Windows
+// are always given by the client, so they are rejected in strict mode.
+func (s *HttpServer) getWindowsArgs(values url.Values) (string, int64, []Window, error) {
+	key, err := s.getRequiredKeyStr("key", values)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	count, err := s.getRequiredKeyInt("count", values)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	s.mu.RLock()
+	strict := s.strict
+	s.mu.RUnlock()
+	if strict {
+		return "", 0, nil, ErrClientLimit
+	}
+	limits, durations := values["limit"], values["duration"]
+	if len(limits) != len(durations) {
+		return "", 0, nil, errors.New("'limit' and 'duration' fields should be given in pairs")
+	}
+	windows := make([]Window, len(limits))
+	for i := range limits {
+		window := url.Values{"limit": {limits[i]}, "duration": {durations[i]}}
+		windows[i].Limit, err = s.getRequiredKeyInt("limit", window)
+		if err != nil {
+			return "", 0, nil, err
+		}
+		windows[i].Duration, err = s.getRequiredKeyDuration("duration", window)
+		if err != nil {
+			return "", 0, nil, err
+		}
+	}
+	return key, count, windows, nil
+}
+
+// getQuotaArgs parses the key, limit, period and optional timezone of a
+// quota request. Quotas are always given by the client, so they are
+// rejected in strict mode.
+func (s *HttpServer) getQuotaArgs(values url.Values) (string, Quota, error) {
+	key, err := s.getRequiredKeyStr("key", values)
+	if err != nil {
+		return "", Quota{}, err
+	}
+	s.mu.RLock()
+	strict := s.strict
+	s.mu.RUnlock()
+	if strict {
+		return "", Quota{}, ErrClientLimit
+	}
+	var quota Quota
+	quota.Limit, err = s.getRequiredKeyInt("limit", values)
+	if err != nil {
+		return "", Quota{}, err
+	}
+	quota.Period, err = s.getRequiredKeyStr("period", values)
+	if err != nil {
+		return "", Quota{}, err
+	}
+	if timezone := values.Get("timezone"); timezone != "" {
+		quota.Location, err = time.LoadLocation(timezone)
+		if err != nil {
+			return "", Quota{}, fmt.Errorf("Unknown timezone '%s'", timezone)
+		}
+	}
+	return key, quota, nil
+}
+
+// getAlgorithm returns the algorithm of key: the one the client asked for,
+// or else the one of its policy. It is empty if neither is set.
+func (s *HttpServer) getAlgorithm(key string, values url.Values) (string, error) {
+	s.mu.RLock()
+	policies, strict := s.policies, s.strict
+	s.mu.RUnlock()
+	algorithm := values.Get("algorithm")
+	if algorithm != "" {
+		if strict {
+			return "", ErrClientLimit
+		}
+		if !IsAlgorithm(algorithm) {
+			return "", ErrUnknownAlgorithm
+		}
+		return algorithm, nil
+	}
+	if policies != nil {
+		if policy, ok := policies.Lookup(key); ok {
+			return policy.Algorithm, nil
+		}
+	}
+	return "", nil
+}
+
+// getBurst returns the burst of key: the one the client asked for, or else
+// the one of its policy unless the client chose another algorithm. It is
+// zero if neither is set.
+func (s *HttpServer) getBurst(key string, values url.Values) (int64, error) {
+	s.mu.RLock()
+	policies, strict := s.policies, s.strict
+	s.mu.RUnlock()
+	if values.Get("burst") != "" {
+		if strict {
+			return 0, ErrClientLimit
+		}
+		return s.getRequiredKeyInt("burst", values)
+	}
+	if policies != nil && values.Get("algorithm") == "" {
+		if policy, ok := policies.Lookup(key); ok {
+			return policy.Burst, nil
+		}
+	}
+	return 0, nil
+}
+
+// keyOptions returns the options to call the limiter with for key, which
+// carry the algorithm and the burst of key.
+func (s *HttpServer) keyOptions(req *http.Request, key string) (Options, error) {
+	algorithm, err := s.getAlgorithm(key, req.URL.Query())
+	if err != nil {
+		return Options{}, err
+	}
+	burst, err := s.getBurst(key, req.URL.Query())
+	if err != nil {
+		return Options{}, err
+	}
+	return Options{Algorithm: algorithm, Burst: burst}, nil
+}
+
 func (s *HttpServer) getRequiredKeyStr(key string, values url.Values) (string, error) {
 	value := values.Get(key)
 	if value == "" {
@@ -139,6 +925,18 @@ func (s *HttpServer) getRequiredKeyInt(key string, values url.Values) (int64, er
 	return parsed, nil
 }
 
+func (s *HttpServer) getOptionalKeyBool(key string, values url.Values) (bool, error) {
+	value := values.Get(key)
+	if value == "" {
+		return false, nil
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, errors.New(fmt.Sprintf("'%s' is not a valid boolean value", key))
+	}
+	return parsed, nil
+}
+
 func (s *HttpServer) getRequiredKeyDuration(key string, values url.Values) (time.Duration, error) {
 	value, err := s.getRequiredKeyStr(key, values)
 	if err != nil {
@@ -151,9 +949,81 @@ func (s *HttpServer) getRequiredKeyDuration(key string, values url.Values) (time
 	return duration, err
 }
 
+// jsonResult is how a Result is rendered for clients that ask for JSON.
+// Durations use the same format as the duration field of requests.
+type jsonResult struct {
+	Used       int64     `json:"used"`
+	Remaining  int64     `json:"remaining"`
+	Limit      int64     `json:"limit"`
+	Burst      int64     `json:"burst"`
+	Window     string    `json:"window"`
+	Reset      time.Time `json:"reset"`
+	RetryAfter string    `json:"retryAfter"`
+	Delay      string    `json:"delay"`
+}
+
+func newJSONResult(result Result) jsonResult {
+	return jsonResult{
+		result.Used,
+		result.Remaining,
+		result.Limit,
+		result.Burst,
+		result.Window.String(),
+		result.Reset.UTC(),
+		result.RetryAfter.String(),
+		result.Delay.String(),
+	}
+}
+
+// wantsJSON reports whether the client asked for a JSON response, either
+// with format=json or with its Accept header. Everyone else gets the
+// plain usage value.
+func wantsJSON(req *http.Request) bool {
+	if req.URL.Query().Get("format") == "json" {
+		return true
+	}
+	return strings.Contains(req.Header.Get("Accept"), "application/json")
+}
+
+func writeResult(w http.ResponseWriter, req *http.Request, result Result) {
+	if wantsJSON(req) {
+		writeJSON(w, newJSONResult(result))
+		return
+	}
+	fmt.Fprintln(w, result.Used)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// setRetryAfter sets the Retry-After header to wait rounded up to whole
+// seconds. It does nothing if wait is zero.
+func setRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	if wait <= 0 {
+		return
+	}
+	seconds := int64(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+}
+
+// setDelay sets the X-Ratelimit-Delay header to how long a queued request
+// has to wait for its turn, in the format of durations. It does nothing
+// if delay is zero.
+func setDelay(w http.ResponseWriter, delay time.Duration) {
+	if delay <= 0 {
+		return
+	}
+	w.Header().Set("X-Ratelimit-Delay", delay.String())
+}
+
 func isLimiterError(err error) bool {
 	list := [...]error{ErrKeyEmpty, ErrCountZero, ErrLimitZero,
-		ErrCountLimit, ErrZeroDuration}
+		ErrCountLimit, ErrZeroDuration, ErrNoItems, ErrNoPolicy, ErrClientLimit,
+		ErrUnknownAlgorithm, ErrAlgorithmNoStorage, ErrLeaseNoStorage,
+		ErrBurstNegative, ErrBurstAlgorithm, ErrNoWindows, ErrDuplicateWindow,
+		ErrUnknownPeriod, ErrLimitTooLarge, ErrDebtAlgorithm}
 	for _, e := range list {
 		if err == e {
 			return true
@@ -161,3 +1031,18 @@ func isLimiterError(err error) bool {
 	}
 	return false
 }
+
+// interruptedCode maps errors of requests that were never answered by the
+// limiter, because their context expired or was cancelled or because the
+// limiter is shutting down, to an HTTP status code.
+func interruptedCode(err error) (int, bool) {
+	switch err {
+	case ErrStopped:
+		return http.StatusServiceUnavailable, true
+	case context.DeadlineExceeded:
+		return http.StatusGatewayTimeout, true
+	case context.Canceled:
+		return http.StatusServiceUnavailable, true
+	}
+	return 0, false
+}
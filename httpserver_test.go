@@ -2,12 +2,15 @@ package ratelimit
 
 import (
 	"bytes"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
 )
 
 func TestHttpServer(t *testing.T) {
@@ -146,3 +149,405 @@ func TestHttpServer404(t *testing.T) {
 		t.Error("Status code is not 404", recorder.Code)
 	}
 }
+
+func TestHttpServerTimeout(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	limiter := NewSingleThreadLimiter(blockingStorage{})
+	limiter.Start()
+	defer limiter.Stop()
+	httpServer := NewHttpServer(limiter, logger)
+	httpServer.SetTimeout(time.Millisecond * 10)
+	recorder := httptest.NewRecorder()
+	values := url.Values{}
+	values.Set("key", "testkey1")
+	request, _ := http.NewRequest("GET", "/?"+values.Encode(), nil)
+	httpServer.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusGatewayTimeout {
+		t.Error("Status code is not 504", recorder.Code)
+	}
+}
+
+func TestHttpServerMaxWait(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	storage := NewDummyStorage()
+	limiter := NewSingleThreadLimiter(storage)
+	limiter.Start()
+	defer limiter.Stop()
+	httpServer := NewHttpServer(limiter, logger)
+	values := url.Values{}
+	values.Set("key", "testkey1")
+	values.Set("count", "1")
+	values.Set("limit", "1")
+	values.Set("duration", "100ms")
+	values.Set("maxWait", "1s")
+	request, _ := http.NewRequest("POST", "/?"+values.Encode(), nil)
+	httpServer.ServeHTTP(httptest.NewRecorder(), request)
+	recorder := httptest.NewRecorder()
+	request, _ = http.NewRequest("POST", "/?"+values.Encode(), nil)
+	httpServer.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Error("Status code is not 200", recorder.Code)
+	}
+
+	values.Set("key", "testkey2")
+	values.Set("duration", "100s")
+	values.Set("maxWait", "10ms")
+	request, _ = http.NewRequest("POST", "/?"+values.Encode(), nil)
+	httpServer.ServeHTTP(httptest.NewRecorder(), request)
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("POST", "/?"+values.Encode(), nil)
+	httpServer.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Error("Status code is not 405", recorder.Code)
+	}
+
+	values.Set("maxWait", "soon")
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("POST", "/?"+values.Encode(), nil)
+	httpServer.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusBadRequest {
+		t.Error("Status code is not 400", recorder.Code)
+	}
+
+	for _, maxWait := range []string{"0s", "-1s"} {
+		values.Set("key", "testkey3")
+		values.Set("maxWait", maxWait)
+		recorder = httptest.NewRecorder()
+		request, _ = http.NewRequest("POST", "/?"+values.Encode(), nil)
+		httpServer.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusBadRequest {
+			t.Error("Status code is not 400 for maxWait", maxWait, recorder.Code)
+		}
+	}
+}
+
+func TestHttpServerReservation(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	storage := NewDummyStorage()
+	limiter := NewSingleThreadLimiter(storage)
+	limiter.Start()
+	defer limiter.Stop()
+	httpServer := NewHttpServer(limiter, logger)
+	recorder := httptest.NewRecorder()
+	values := url.Values{}
+	values.Set("key", "testkey1")
+	values.Set("count", "4")
+	values.Set("limit", "10")
+	values.Set("duration", "100s")
+	request, _ := http.NewRequest("POST", "/reserve?"+values.Encode(), nil)
+	httpServer.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Error("Status code is not 200", recorder.Code)
+	}
+	var id string
+	var used int64
+	fmt.Sscan(recorder.Body.String(), &id, &used)
+	if used != 4 {
+		t.Error("Response body is wrong:", recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("POST", "/cancel?id="+id, nil)
+	httpServer.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Error("Status code is not 200", recorder.Code)
+	}
+	if result, _ := limiter.Get("testkey1"); result.Used != 0 {
+		t.Error("Cancelled reservation should be refunded", result.Used)
+	}
+
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("POST", "/commit?id="+id, nil)
+	httpServer.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusNotFound {
+		t.Error("Status code is not 404", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("GET", "/commit?id="+id, nil)
+	httpServer.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Error("Status code is not 405", recorder.Code)
+	}
+}
+
+func TestHttpServerRefund(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	storage := NewDummyStorage()
+	limiter := NewSingleThreadLimiter(storage)
+	limiter.Start()
+	defer limiter.Stop()
+	httpServer := NewHttpServer(limiter, logger)
+	limiter.Post("testkey1", 10, 10, time.Second*100)
+	recorder := httptest.NewRecorder()
+	values := url.Values{}
+	values.Set("key", "testkey1")
+	values.Set("count", "7")
+	request, _ := http.NewRequest("POST", "/refund?"+values.Encode(), nil)
+	httpServer.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Error("Status code is not 200", recorder.Code)
+	}
+	if bytes.Equal(recorder.Body.Bytes(), []byte("3\n")) == false {
+		t.Error("Response body is wrong:", recorder.Body.String())
+	}
+
+	values.Set("key", "testkey2")
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("POST", "/refund?"+values.Encode(), nil)
+	httpServer.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusNotFound {
+		t.Error("Status code is not 404", recorder.Code)
+	}
+
+	values.Set("count", "-1")
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("POST", "/refund?"+values.Encode(), nil)
+	httpServer.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusBadRequest {
+		t.Error("Status code is not 400", recorder.Code)
+	}
+}
+
+func TestHttpServerBatch(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	storage := NewDummyStorage()
+	limiter := NewSingleThreadLimiter(storage)
+	limiter.Start()
+	defer limiter.Stop()
+	httpServer := NewHttpServer(limiter, logger)
+	limiter.Post("testkey2", 10, 10, time.Second*100)
+	recorder := httptest.NewRecorder()
+	values := url.Values{}
+	values.Add("key", "testkey1")
+	values.Add("count", "1")
+	values.Add("limit", "10")
+	values.Add("duration", "100s")
+	request, _ := http.NewRequest("POST", "/batch?"+values.Encode(), nil)
+	httpServer.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Error("Status code is not 200", recorder.Code)
+	}
+	if bytes.Equal(recorder.Body.Bytes(), []byte("1\n")) == false {
+		t.Error("Response body is wrong:", recorder.Body.String())
+	}
+
+	values.Add("key", "testkey2")
+	values.Add("count", "1")
+	values.Add("limit", "10")
+	values.Add("duration", "100s")
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("POST", "/batch?"+values.Encode(), nil)
+	httpServer.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Error("Status code is not 405", recorder.Code)
+	}
+	if bytes.Equal(recorder.Body.Bytes(), []byte("testkey2: Limit reached\n")) == false {
+		t.Error("Response body is wrong:", recorder.Body.String())
+	}
+	if result, _ := limiter.Get("testkey1"); result.Used != 1 {
+		t.Error("Rejected batch shouldn't consume other keys", result.Used)
+	}
+
+	values.Del("limit")
+	values.Add("limit", "10")
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("POST", "/batch?"+values.Encode(), nil)
+	httpServer.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusBadRequest {
+		t.Error("Status code is not 400", recorder.Code)
+	}
+}
+
+func TestHttpServerDryRun(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	storage := NewDummyStorage()
+	limiter := NewSingleThreadLimiter(storage)
+	limiter.Start()
+	defer limiter.Stop()
+	httpServer := NewHttpServer(limiter, logger)
+	limiter.Post("testkey1", 9, 10, time.Second*100)
+	recorder := httptest.NewRecorder()
+	values := url.Values{}
+	values.Set("key", "testkey1")
+	values.Set("count", "1")
+	values.Set("limit", "10")
+	values.Set("duration", "100s")
+	values.Set("dryRun", "true")
+	request, _ := http.NewRequest("POST", "/?"+values.Encode(), nil)
+	httpServer.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Error("Status code is not 200", recorder.Code)
+	}
+	if bytes.Equal(recorder.Body.Bytes(), []byte("10\n")) == false {
+		t.Error("Response body is wrong:", recorder.Body.String())
+	}
+	if result, _ := limiter.Get("testkey1"); result.Used != 9 {
+		t.Error("Dry run shouldn't consume tokens", result.Used)
+	}
+
+	values.Set("dryRun", "maybe")
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("POST", "/?"+values.Encode(), nil)
+	httpServer.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusBadRequest {
+		t.Error("Status code is not 400", recorder.Code)
+	}
+}
+
+func TestHttpServerRetryAfter(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	storage := NewDummyStorage()
+	limiter := NewSingleThreadLimiter(storage)
+	limiter.Start()
+	defer limiter.Stop()
+	httpServer := NewHttpServer(limiter, logger)
+	limiter.Post("testkey1", 10, 10, time.Second*100)
+	recorder := httptest.NewRecorder()
+	values := url.Values{}
+	values.Set("key", "testkey1")
+	values.Set("count", "5")
+	values.Set("limit", "10")
+	values.Set("duration", "100s")
+	request, _ := http.NewRequest("POST", "/?"+values.Encode(), nil)
+	httpServer.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Error("Status code is not 405", recorder.Code)
+	}
+	if retryAfter := recorder.Header().Get("Retry-After"); retryAfter != "50" {
+		t.Error("Retry-After header is wrong:", retryAfter)
+	}
+
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("GET", "/?key=testkey1&count=2", nil)
+	httpServer.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Error("Status code is not 200", recorder.Code)
+	}
+	if retryAfter := recorder.Header().Get("Retry-After"); retryAfter != "20" {
+		t.Error("Retry-After header is wrong:", retryAfter)
+	}
+}
+
+func TestHttpServerJSON(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	storage := NewDummyStorage()
+	limiter := NewSingleThreadLimiter(storage)
+	limiter.Start()
+	defer limiter.Stop()
+	httpServer := NewHttpServer(limiter, logger)
+	recorder := httptest.NewRecorder()
+	values := url.Values{}
+	values.Set("key", "testkey1")
+	values.Set("count", "4")
+	values.Set("limit", "10")
+	values.Set("duration", "100s")
+	values.Set("format", "json")
+	request, _ := http.NewRequest("POST", "/?"+values.Encode(), nil)
+	httpServer.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Error("Status code is not 200", recorder.Code)
+	}
+	var result jsonResult
+	err := json.Unmarshal(recorder.Body.Bytes(), &result)
+	if err != nil {
+		t.Error(err, recorder.Body.String())
+	}
+	if result.Used != 4 || result.Remaining != 6 || result.Limit != 10 || result.Window != "1m40s" {
+		t.Error("Response body is wrong:", recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("GET", "/?key=testkey1", nil)
+	request.Header.Set("Accept", "application/json")
+	httpServer.ServeHTTP(recorder, request)
+	if recorder.Header().Get("Content-Type") != "application/json" {
+		t.Error("Content-Type is wrong:", recorder.Header().Get("Content-Type"))
+	}
+
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("GET", "/?key=testkey1", nil)
+	httpServer.ServeHTTP(recorder, request)
+	if bytes.Equal(recorder.Body.Bytes(), []byte("4\n")) == false {
+		t.Error("Plain response body is wrong:", recorder.Body.String())
+	}
+}
+
+func TestHttpServerPolicies(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	storage := NewDummyStorage()
+	limiter := NewSingleThreadLimiter(storage)
+	limiter.Start()
+	defer limiter.Stop()
+	httpServer := NewHttpServer(limiter, logger)
+	registry, _ := NewPolicyRegistry([]Policy{{MatchPrefix, "user:", 2, time.Second * 100, "", 0}})
+	httpServer.SetPolicies(registry, false)
+	post := func(query string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("POST", "/?"+query, nil)
+		httpServer.ServeHTTP(recorder, request)
+		return recorder
+	}
+	if recorder := post("key=user:1&count=2"); recorder.Code != http.StatusOK {
+		t.Error("Status code is not 200", recorder.Code)
+	}
+	if recorder := post("key=user:1&count=1"); recorder.Code != http.StatusMethodNotAllowed {
+		t.Error("Policy limit should apply", recorder.Code)
+	}
+	if recorder := post("key=user:2&count=3&limit=5"); recorder.Code != http.StatusOK {
+		t.Error("Client limit should override the policy", recorder.Code)
+	}
+	if recorder := post("key=other&count=1"); recorder.Code != http.StatusBadRequest {
+		t.Error("Keys without a policy need a limit", recorder.Code)
+	}
+
+	httpServer.SetPolicies(registry, true)
+	if recorder := post("key=user:3&count=1"); recorder.Code != http.StatusOK {
+		t.Error("Status code is not 200", recorder.Code)
+	}
+	recorder := post("key=user:3&count=1&limit=5")
+	if recorder.Code != http.StatusBadRequest {
+		t.Error("Strict mode should reject client limits", recorder.Code)
+	}
+	if bytes.Equal(recorder.Body.Bytes(), []byte("Limit, duration, algorithm and burst are set by the server\n")) == false {
+		t.Error("Response body is wrong:", recorder.Body.String())
+	}
+	if recorder := post("key=other&count=1&limit=5&duration=1s"); recorder.Code != http.StatusBadRequest {
+		t.Error("Strict mode should reject keys without a policy", recorder.Code)
+	}
+}
+
+func TestHttpServerBurst(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	limiter := NewShardedLimiter(NewDummyStorage(), 1)
+	httpServer := NewHttpServer(limiter, logger)
+	registry, _ := NewPolicyRegistry([]Policy{{MatchPrefix, "user:", 10, time.Second, "", 50}})
+	httpServer.SetPolicies(registry, false)
+	post := func(query string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("POST", "/?"+query, nil)
+		httpServer.ServeHTTP(recorder, request)
+		return recorder
+	}
+	if recorder := post("key=other&count=20&limit=10&duration=1m&burst=20"); recorder.Code != http.StatusOK {
+		t.Error("Client burst should apply", recorder.Code, recorder.Body.String())
+	}
+	if recorder := post("key=user:1&count=50"); recorder.Code != http.StatusOK {
+		t.Error("Policy burst should apply", recorder.Code, recorder.Body.String())
+	}
+	if recorder := post("key=user:2&count=50&algorithm=tokenbucket"); recorder.Code != http.StatusBadRequest {
+		t.Error("Policy burst should not apply to another algorithm choice", recorder.Code)
+	}
+	if recorder := post("key=other&count=1&limit=10&duration=1m&burst=20&algorithm=gcra"); recorder.Code != http.StatusBadRequest {
+		t.Error("Burst should be rejected for other algorithms", recorder.Code)
+	}
+	if recorder := post("key=other&count=1&limit=10&duration=1m&burst=x"); recorder.Code != http.StatusBadRequest {
+		t.Error("Invalid burst should be rejected", recorder.Code)
+	}
+	httpServer.SetPolicies(registry, true)
+	if recorder := post("key=user:3&count=1&burst=100"); recorder.Code != http.StatusBadRequest {
+		t.Error("Strict mode should reject client bursts", recorder.Code)
+	}
+}
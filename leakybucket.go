@@ -0,0 +1,54 @@
+package ratelimit
+
+import (
+	"time"
+)
+
+// leakyBucketAlgorithm shapes traffic to a steady rate instead of letting
+// bursts through. Requests are queued and given consecutive slots spaced
+// by duration/limit, and Result.Delay tells the caller how long to wait
+// for its slot. The queue holds up to limit tokens, so a caller waits at
+// most duration, and requests are only rejected when it is full.
+//
+// Its state is the TAT of GCRA, kept apart from the GCRA state of the key.
+type leakyBucketAlgorithm struct{}
+
+// delay is how long after now the first of count tokens gets its slot,
+// given the result of queueing them.
+func delay(result Result, count int64, now time.Time) time.Duration {
+	state := &GCRAState{Limit: result.Limit, Duration: result.Window}
+	delay := result.Reset.Sub(now) - state.interval(count)
+	if delay < 0 {
+		return 0
+	}
+	return delay
+}
+
+func (leakyBucketAlgorithm) post(storage Storage, settings settings, now time.Time, req request, peek bool) response {
+	req.key = stateKey(AlgorithmLeakyBucket, req.key)
+	res := gcraAlgorithm{}.post(storage, settings, now, req, peek)
+	if res.err == nil {
+		res.result.Delay = delay(res.result, req.count, now)
+	}
+	return res
+}
+
+func (leakyBucketAlgorithm) get(storage Storage, settings settings, now time.Time, req request) response {
+	req.key = stateKey(AlgorithmLeakyBucket, req.key)
+	res := gcraAlgorithm{}.get(storage, settings, now, req)
+	if res.err == nil && res.result.RetryAfter == 0 {
+		// The slot that count more tokens would get
+		res.result.Delay = res.result.Reset.Sub(now)
+	}
+	return res
+}
+
+func (leakyBucketAlgorithm) refund(storage Storage, settings settings, now time.Time, req request) response {
+	req.key = stateKey(AlgorithmLeakyBucket, req.key)
+	return gcraAlgorithm{}.refund(storage, settings, now, req)
+}
+
+func (leakyBucketAlgorithm) remove(storage Storage, settings settings, now time.Time, req request) response {
+	req.key = stateKey(AlgorithmLeakyBucket, req.key)
+	return gcraAlgorithm{}.remove(storage, settings, now, req)
+}
@@ -0,0 +1,86 @@
+package ratelimit
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLeakyBucket(t *testing.T) {
+	storage := NewDummyStorage()
+	clock := NewFakeClock(time.Now())
+	limiter := NewSingleThreadLimiter(storage)
+	limiter.SetClock(clock)
+	limiter.Start()
+	defer limiter.Stop()
+	ctx := context.Background()
+	opts := Options{Algorithm: AlgorithmLeakyBucket}
+	// One slot every 100ms, up to a second of queue
+	duration := time.Second
+	for i := int64(0); i < 10; i++ {
+		result, err := limiter.PostContext(ctx, "testkey1", 1, 10, duration, opts)
+		if err != nil {
+			t.Error(err)
+		}
+		if result.Delay != time.Duration(i)*time.Millisecond*100 {
+			t.Error("Requests should be spaced by 100ms", i, result.Delay)
+		}
+	}
+	result, err := limiter.PostContext(ctx, "testkey1", 1, 10, duration, opts)
+	if err != ErrLimitReached {
+		t.Error("A full queue should reject", result, err)
+	}
+	if result.RetryAfter != time.Millisecond*100 {
+		t.Error("RetryAfter should be when the first slot frees", result.RetryAfter)
+	}
+	result, err = limiter.GetResult(ctx, "testkey1", 1, opts)
+	if err != nil || result.Used != 10 || result.Delay != 0 {
+		t.Error("A full queue should have no slot to report", result, err)
+	}
+
+	clock.Advance(time.Millisecond * 250)
+	result, err = limiter.GetContext(ctx, "testkey1", opts)
+	if err != nil || result.Delay != time.Millisecond*750 {
+		t.Error("Get should report the next free slot", result, err)
+	}
+	result, err = limiter.PostContext(ctx, "testkey1", 2, 10, duration, opts)
+	if err != nil || result.Delay != time.Millisecond*750 {
+		t.Error("Post should get the next free slot", result, err)
+	}
+
+	if state, _ := storage.GetGCRA(context.Background(), "testkey1"); state != nil {
+		t.Error("The GCRA state of the key should not be shared", state)
+	}
+	if err := limiter.DeleteContext(ctx, "testkey1", opts); err != nil {
+		t.Error(err)
+	}
+	if _, err := limiter.GetContext(ctx, "testkey1", opts); err != ErrNotFound {
+		t.Error("Key should be deleted", err)
+	}
+}
+
+func TestHttpServerLeakyBucket(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	limiter := NewShardedLimiter(NewDummyStorage(), 1)
+	limiter.SetClock(NewFakeClock(time.Now()))
+	httpServer := NewHttpServer(limiter, logger)
+	post := func() *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("POST", "/?key=testkey1&count=1&limit=2&duration=1s&algorithm=leakybucket", nil)
+		httpServer.ServeHTTP(recorder, request)
+		return recorder
+	}
+	if recorder := post(); recorder.Code != http.StatusOK || recorder.Header().Get("X-Ratelimit-Delay") != "" {
+		t.Error("The first request should not wait", recorder.Code, recorder.Header())
+	}
+	if recorder := post(); recorder.Code != http.StatusOK || recorder.Header().Get("X-Ratelimit-Delay") != "500ms" {
+		t.Error("The second request should wait 500ms", recorder.Code, recorder.Header())
+	}
+	if recorder := post(); recorder.Code != http.StatusMethodNotAllowed {
+		t.Error("A full queue should reject", recorder.Code)
+	}
+}
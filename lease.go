@@ -0,0 +1,131 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	ErrLeaseNotFound  = errors.New("Lease not found")
+	ErrLeaseNoStorage = errors.New("Leases are not supported by the storage")
+)
+
+// A Lease holds one of the concurrent slots of a key until it is released
+// or it expires, so that a client that crashes before releasing it does
+// not keep the slot forever.
+type Lease struct {
+	ID      string
+	Key     string
+	Expires time.Time
+}
+
+// Leases is what the concurrency limiter reads for a key: how many leases
+// it holds and when the first and the last of them expire.
+type Leases struct {
+	Held  int64
+	First time.Time
+	Last  time.Time
+}
+
+// LeaseStorage is implemented by the storages that can keep the leases of
+// the concurrency limiter.
+type LeaseStorage interface {
+	// AcquireLease adds the lease id to key, unless key already holds
+	// limit leases that have not expired at now. It drops the expired
+	// leases of key and returns the leases it holds afterwards, along with
+	// whether id was added.
+	AcquireLease(ctx context.Context, key, id string, limit int64, now, expires time.Time) (*Leases, bool, error)
+	// ReleaseLease removes the lease id from key. It returns
+	// ErrLeaseNotFound if key does not hold it or it expired before now.
+	ReleaseLease(ctx context.Context, key, id string, now time.Time) error
+}
+
+func leaseStorage(storage Storage) (LeaseStorage, error) {
+	s, ok := storage.(LeaseStorage)
+	if !ok {
+		return nil, ErrLeaseNoStorage
+	}
+	return s, nil
+}
+
+// leaseResult describes the leases of a key that allows limit of them at
+// once, each for ttl. Used is the number of leases held, Reset is when the
+// last of them expires and RetryAfter is how long until the first does if
+// the caller was turned away.
+func leaseResult(leases *Leases, acquired bool, limit int64, ttl time.Duration, now time.Time) Result {
+	remaining := limit - leases.Held
+	if remaining < 0 {
+		remaining = 0
+	}
+	reset := now
+	if leases.Held > 0 {
+		reset = leases.Last
+	}
+	var retryAfter time.Duration
+	if !acquired && leases.First.After(now) {
+		retryAfter = leases.First.Sub(now)
+	}
+	return Result{
+		Used:       leases.Held,
+		Remaining:  remaining,
+		Limit:      limit,
+		Window:     ttl,
+		Reset:      reset,
+		RetryAfter: retryAfter,
+	}
+}
+
+// handleAcquire takes a lease of req.key for req.duration if it holds
+// fewer than req.limit of them.
+func handleAcquire(storage Storage, now time.Time, req request) response {
+	s, err := leaseStorage(storage)
+	if err != nil {
+		return response{err: err}
+	}
+	id, err := newID()
+	if err != nil {
+		return response{err: err}
+	}
+	lease := &Lease{id, req.key, now.Add(req.duration)}
+	leases, acquired, err := s.AcquireLease(req.ctx, req.key, id, req.limit, now, lease.Expires)
+	if err != nil {
+		return response{err: err}
+	}
+	result := leaseResult(leases, acquired, req.limit, req.duration, now)
+	if !acquired {
+		return response{result: result, err: ErrLimitReached}
+	}
+	return response{result: result, lease: lease}
+}
+
+func handleRelease(storage Storage, now time.Time, req request) response {
+	s, err := leaseStorage(storage)
+	if err != nil {
+		return response{err: err}
+	}
+	return response{err: s.ReleaseLease(req.ctx, req.key, req.id, now)}
+}
+
+func checkAcquireArgs(key string, limit int64, ttl time.Duration) error {
+	switch true {
+	case len(strings.TrimSpace(key)) == 0:
+		return ErrKeyEmpty
+	case limit <= 0:
+		return ErrLimitZero
+	case ttl <= 0:
+		return ErrZeroDuration
+	}
+	return nil
+}
+
+func checkReleaseArgs(key, id string) error {
+	switch true {
+	case len(strings.TrimSpace(key)) == 0:
+		return ErrKeyEmpty
+	case id == "":
+		return ErrLeaseNotFound
+	}
+	return nil
+}
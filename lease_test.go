@@ -0,0 +1,119 @@
+package ratelimit
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLease(t *testing.T) {
+	storage := NewDummyStorage()
+	clock := NewFakeClock(time.Now())
+	limiter := NewSingleThreadLimiter(storage)
+	limiter.SetClock(clock)
+	limiter.Start()
+	defer limiter.Stop()
+	ctx := context.Background()
+	first, result, err := limiter.Acquire(ctx, "testkey1", 2, time.Minute)
+	if err != nil || result.Used != 1 || result.Remaining != 1 {
+		t.Error("The first lease should be acquired", result, err)
+	}
+	clock.Advance(time.Second * 10)
+	second, _, err := limiter.Acquire(ctx, "testkey1", 2, time.Minute)
+	if err != nil || second.ID == first.ID {
+		t.Error("The second lease should be acquired", second, err)
+	}
+	if !second.Expires.Equal(clock.Now().Add(time.Minute)) {
+		t.Error("The lease should expire after its TTL", second.Expires)
+	}
+	_, result, err = limiter.Acquire(ctx, "testkey1", 2, time.Minute)
+	if err != ErrLimitReached || result.Used != 2 {
+		t.Error("Every slot should be taken", result, err)
+	}
+	if result.RetryAfter != time.Second*50 || !result.Reset.Equal(second.Expires) {
+		t.Error("RetryAfter should be when the first lease expires", result)
+	}
+
+	if err := limiter.Release(ctx, "testkey1", second.ID); err != nil {
+		t.Error(err)
+	}
+	if err := limiter.Release(ctx, "testkey1", second.ID); err != ErrLeaseNotFound {
+		t.Error("A lease should only be released once", err)
+	}
+	third, result, err := limiter.Acquire(ctx, "testkey1", 2, time.Minute)
+	if err != nil || result.Used != 2 {
+		t.Error("Release should free the slot", result, err)
+	}
+
+	// The first lease is never released
+	clock.Advance(time.Second * 50)
+	if err := limiter.Release(ctx, "testkey1", first.ID); err != ErrLeaseNotFound {
+		t.Error("An expired lease cannot be released", err)
+	}
+	_, result, err = limiter.Acquire(ctx, "testkey1", 2, time.Minute)
+	if err != nil || result.Used != 2 {
+		t.Error("An expired lease should free its slot", result, err)
+	}
+	if err := limiter.Release(ctx, "testkey1", third.ID); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLeaseArgs(t *testing.T) {
+	limiter := NewShardedLimiter(NewDummyStorage(), 4)
+	ctx := context.Background()
+	if _, _, err := limiter.Acquire(ctx, " ", 1, time.Minute); err != ErrKeyEmpty {
+		t.Error("Key should be required", err)
+	}
+	if _, _, err := limiter.Acquire(ctx, "testkey1", 0, time.Minute); err != ErrLimitZero {
+		t.Error("Limit should be required", err)
+	}
+	if _, _, err := limiter.Acquire(ctx, "testkey1", 1, 0); err != ErrZeroDuration {
+		t.Error("TTL should be required", err)
+	}
+	if err := limiter.Release(ctx, "testkey1", ""); err != ErrLeaseNotFound {
+		t.Error("Lease id should be required", err)
+	}
+	memcache := NewShardedLimiter(&MemcacheStorage{}, 1)
+	if _, _, err := memcache.Acquire(ctx, "testkey1", 1, time.Minute); err != ErrLeaseNoStorage {
+		t.Error("Memcache should not support leases", err)
+	}
+}
+
+func TestHttpServerLease(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	limiter := NewShardedLimiter(NewDummyStorage(), 1)
+	httpServer := NewHttpServer(limiter, logger)
+	serve := func(path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("POST", path, nil)
+		httpServer.ServeHTTP(recorder, request)
+		return recorder
+	}
+	recorder := serve("/acquire?key=testkey1&limit=1&duration=1m")
+	if recorder.Code != http.StatusOK {
+		t.Error("Status code is not 200", recorder.Code)
+	}
+	fields := strings.Fields(recorder.Body.String())
+	if len(fields) != 2 || fields[1] != "1" {
+		t.Error("Body should be the lease id and the leases held", recorder.Body.String())
+	}
+	recorder = serve("/acquire?key=testkey1&limit=1&duration=1m")
+	if recorder.Code != http.StatusMethodNotAllowed || recorder.Header().Get("Retry-After") != "60" {
+		t.Error("Every slot should be taken", recorder.Code, recorder.Header())
+	}
+	if recorder = serve("/release?key=testkey1&id=" + fields[0]); recorder.Code != http.StatusOK {
+		t.Error("Status code is not 200", recorder.Code)
+	}
+	if recorder = serve("/release?key=testkey1&id=" + fields[0]); recorder.Code != http.StatusNotFound {
+		t.Error("Released leases should not be found", recorder.Code)
+	}
+	if recorder = serve("/acquire?key=testkey1&limit=1"); recorder.Code != http.StatusBadRequest {
+		t.Error("Duration should be required", recorder.Code)
+	}
+}
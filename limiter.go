@@ -1,152 +1,694 @@
 package ratelimit
 
 import (
+	"context"
 	"errors"
 	"math"
 	"strings"
+	"sync"
 	"time"
 )
 
 var (
-	ErrKeyEmpty     = errors.New("Key cannot be empty")
-	ErrCountZero    = errors.New("Count should be greater than zero")
-	ErrLimitZero    = errors.New("Limit should be greater than zero")
-	ErrCountLimit   = errors.New("Limit should be greater than count")
-	ErrZeroDuration = errors.New("Duration cannot be zero")
+	ErrKeyEmpty      = errors.New("Key cannot be empty")
+	ErrCountZero     = errors.New("Count should be greater than zero")
+	ErrLimitZero     = errors.New("Limit should be greater than zero")
+	ErrCountLimit    = errors.New("Limit should be greater than count")
+	ErrZeroDuration  = errors.New("Duration cannot be zero")
+	ErrStopped       = errors.New("Limiter is stopped")
+	ErrBurstNegative = errors.New("Burst cannot be negative")
+	ErrLimitTooLarge = errors.New("Limit and burst are too large")
 )
 
 type Limiter interface {
-	Get(key string) (int64, error)
-	Post(key string, count int64, limit int64, duration time.Duration) (int64, error)
+	Get(key string) (Result, error)
+	Post(key string, count int64, limit int64, duration time.Duration) (Result, error)
 	Delete(key string) error
+	GetContext(ctx context.Context, key string, opts Options) (Result, error)
+	GetResult(ctx context.Context, key string, count int64, opts Options) (Result, error)
+	PostContext(ctx context.Context, key string, count int64, limit int64, duration time.Duration, opts Options) (Result, error)
+	PostMulti(ctx context.Context, items []PostItem) ([]Result, error)
+	PostWindows(ctx context.Context, key string, count int64, windows []Window, opts Options) ([]Result, int, error)
+	PostQuota(ctx context.Context, key string, count int64, quota Quota) (Result, error)
+	GetQuota(ctx context.Context, key string, quota Quota) (Result, error)
+	Peek(ctx context.Context, key string, count int64, limit int64, duration time.Duration, opts Options) (Result, error)
+	Check(ctx context.Context, key string, limit int64, duration time.Duration, opts Options) (Result, error)
+	Charge(ctx context.Context, key string, count int64, limit int64, duration time.Duration, opts Options) (Result, error)
+	DeleteContext(ctx context.Context, key string, opts Options) error
+	Wait(ctx context.Context, key string, count int64, limit int64, duration time.Duration, opts Options) (Result, error)
+	Refund(key string, count int64) (Result, error)
+	RefundContext(ctx context.Context, key string, count int64, opts Options) (Result, error)
+	Reserve(ctx context.Context, key string, count int64, limit int64, duration time.Duration, opts Options) (*Reservation, error)
+	Commit(id string) error
+	Cancel(ctx context.Context, id string) error
+	Acquire(ctx context.Context, key string, limit int64, ttl time.Duration) (*Lease, Result, error)
+	Release(ctx context.Context, key, id string) error
+	Shutdown(ctx context.Context) error
 }
 
-type SingleThreadLimiter struct {
-	storage  Storage
-	reqChan  chan request
-	stopChan chan int
+// A Result describes the bucket of a key after a request. Remaining is
+// what is left of Limit in the current Window, or of Burst for a token
+// bucket posted with one. Reset is when the bucket will be fully refilled
+// and RetryAfter is how long the caller has to wait until the tokens it
+// asked for are available, zero if they are available now. Delay is only
+// set by AlgorithmLeakyBucket, which queues requests: it is how long the
+// caller has to wait for its turn. Burst is only set by
+// AlgorithmTokenBucket: it is how many tokens the bucket holds, which is
+// Limit unless the bucket was posted with a burst.
+type Result struct {
+	Used       int64
+	Remaining  int64
+	Limit      int64
+	Burst      int64
+	Window     time.Duration
+	Reset      time.Time
+	RetryAfter time.Duration
+	Delay      time.Duration
 }
 
-func NewSingleThreadLimiter(storage Storage) *SingleThreadLimiter {
-	return &SingleThreadLimiter{storage, make(chan request), make(chan int)}
+// newResult describes bucket at now for a caller that wants count tokens.
+func newResult(bucket *TokenBucket, count int64, now time.Time) Result {
+	used := bucket.GetAdjustedUsage(now).Ceil()
+	capacity := bucket.Capacity()
+	remaining := capacity - used
+	if remaining < 0 {
+		remaining = 0
+	}
+	return Result{
+		Used:      used,
+		Remaining: remaining,
+		Limit:     bucket.Limit,
+		Burst:     capacity,
+		Window:    bucket.Duration,
+		// Waiting for a whole bucket of tokens is waiting for an empty one
+		Reset:      now.Add(bucket.WaitTime(capacity, now)),
+		RetryAfter: bucket.WaitTime(count, now),
+	}
 }
 
-func (l *SingleThreadLimiter) Start() {
-	go l.serve()
+// core is what SingleThreadLimiter and ShardedLimiter share: the checks of
+// the arguments of every operation and the requests built from them. The
+// limiters only differ in how they dispatch a request to handle.
+type core struct {
+	storage      Storage
+	settings     settings
+	inflight     inflight
+	reservations *reservations
+	dispatch     func(req request) response
 }
 
-func (l *SingleThreadLimiter) Stop() {
-	l.stopChan <- 1
+func newCore(storage Storage) core {
+	return core{
+		storage:      storage,
+		settings:     settings{clock: SystemClock},
+		reservations: newReservations(),
+	}
+}
+
+// SetReservationTTL sets how long reservations stay open before they
+// expire. It defaults to DefaultReservationTTL.
+func (l *core) SetReservationTTL(ttl time.Duration) {
+	l.reservations.setTTL(ttl)
+}
+
+// SetClock sets the clock that buckets and reservations are refilled and
+// expired by. It defaults to SystemClock and must be set before the
+// limiter is started or used.
+func (l *core) SetClock(clock Clock) {
+	l.settings.clock = clock
+	l.reservations.setClock(clock)
+}
+
+// SetMigration sets how buckets keep their usage when a request changes
+// their limit or duration. It defaults to CarryOver and must be set
+// before the limiter is started or used.
+func (l *core) SetMigration(migration Migration) {
+	l.settings.migration = migration
+}
+
+// SetLocation aligns fixed windows to the wall clock of location, so that
+// for example daily windows start at its midnight. By default they are
+// aligned to the Unix epoch, which is UTC. It must be set before the
+// limiter is started or used.
+func (l *core) SetLocation(location *time.Location) {
+	l.settings.location = location
+}
+
+func (l *core) Post(key string, count, limit int64, duration time.Duration) (Result, error) {
+	return l.PostContext(context.Background(), key, count, limit, duration, Options{})
+}
+
+func (l *core) Get(key string) (Result, error) {
+	return l.GetContext(context.Background(), key, Options{})
+}
+
+func (l *core) Delete(key string) error {
+	return l.DeleteContext(context.Background(), key, Options{})
+}
+
+func (l *core) PostContext(ctx context.Context, key string, count, limit int64, duration time.Duration, opts Options) (Result, error) {
+
+	err := checkPostArgs(key, count, limit, opts.Burst, duration)
+
+	if err != nil {
+		return Result{}, err
+	}
+
+	req := request{
+		ctx:       ctx,
+		method:    POST,
+		algorithm: opts.Algorithm,
+		key:       key,
+		count:     count,
+		limit:     limit,
+		burst:     opts.Burst,
+		duration:  duration,
+	}
+	res := l.dispatch(req)
+	return res.result, res.err
+}
+
+// Peek is a dry run of Post. It reports whether the tokens could be
+// consumed and what the usage would be afterwards, without consuming them.
+func (l *core) Peek(ctx context.Context, key string, count, limit int64, duration time.Duration, opts Options) (Result, error) {
+
+	err := checkPostArgs(key, count, limit, opts.Burst, duration)
+
+	if err != nil {
+		return Result{}, err
+	}
+
+	req := request{
+		ctx:       ctx,
+		method:    PEEK,
+		algorithm: opts.Algorithm,
+		key:       key,
+		count:     count,
+		limit:     limit,
+		burst:     opts.Burst,
+		duration:  duration,
+	}
+	res := l.dispatch(req)
+	return res.result, res.err
+}
+
+// Check is Peek for a single token: it fails with ErrLimitReached while
+// the key has no token left, including while it is in debt after Charge.
+func (l *core) Check(ctx context.Context, key string, limit int64, duration time.Duration, opts Options) (Result, error) {
+	return l.Peek(ctx, key, 1, limit, duration, opts)
+}
+
+// Charge consumes count tokens that have already been spent, so it never
+// fails for lack of them. Usage past the capacity of the bucket is debt,
+// which refill has to repay before Post or Check succeed again. Charge is
+// only supported by AlgorithmTokenBucket.
+func (l *core) Charge(ctx context.Context, key string, count, limit int64, duration time.Duration, opts Options) (Result, error) {
+
+	err := checkChargeArgs(key, count, limit, opts.Burst, duration)
+
+	if err != nil {
+		return Result{}, err
+	}
+
+	req := request{
+		ctx:       ctx,
+		method:    CHARGE,
+		algorithm: opts.Algorithm,
+		key:       key,
+		count:     count,
+		limit:     limit,
+		burst:     opts.Burst,
+		duration:  duration,
+	}
+	res := l.dispatch(req)
+	return res.result, res.err
+}
+
+// PostMulti consumes the tokens of all items or, if any of them would
+// reach its limit, of none. The error of a failing item is a *KeyError
+// carrying its key. On success it returns the usage of every item.
+func (l *core) PostMulti(ctx context.Context, items []PostItem) ([]Result, error) {
+
+	err := checkMultiArgs(items)
+
+	if err != nil {
+		return nil, err
+	}
+
+	req := request{
+		ctx:    ctx,
+		method: MULTI,
+		items:  items,
+	}
+	res := l.dispatch(req)
+	return res.multi, res.err
+}
+
+// PostWindows consumes count tokens from every window of key or, if any of
+// them would reach its limit, from none. It returns the usage of every
+// window, in order, and the index of the binding one: the window that
+// turned the request away, or else the one with the fewest tokens left.
+func (l *core) PostWindows(ctx context.Context, key string, count int64, windows []Window, opts Options) ([]Result, int, error) {
+	if err := checkWindowsArgs(key, count, windows); err != nil {
+		return nil, 0, err
+	}
+	req := request{
+		ctx:       ctx,
+		method:    WINDOWS,
+		algorithm: opts.Algorithm,
+		key:       key,
+		count:     count,
+		windows:   windows,
+	}
+	res := l.dispatch(req)
+	return res.multi, res.binding, res.err
+}
+
+// PostQuota consumes count tokens from the quota of key for the current
+// calendar period. Reset is when the next period starts.
+func (l *core) PostQuota(ctx context.Context, key string, count int64, quota Quota) (Result, error) {
+	if err := checkQuotaArgs(key, count, quota); err != nil {
+		return Result{}, err
+	}
+	req := request{
+		ctx:      ctx,
+		method:   POST,
+		key:      key,
+		count:    count,
+		limit:    quota.Limit,
+		period:   quota.Period,
+		location: quota.Location,
+	}
+	res := l.dispatch(req)
+	return res.result, res.err
+}
+
+// GetQuota returns the usage of the quota of key in the current calendar
+// period, or ErrNotFound if it was not posted to in this period.
+func (l *core) GetQuota(ctx context.Context, key string, quota Quota) (Result, error) {
+	if err := checkQuotaArgs(key, 1, quota); err != nil {
+		return Result{}, err
+	}
+	req := request{
+		ctx:      ctx,
+		method:   GET,
+		key:      key,
+		count:    1,
+		limit:    quota.Limit,
+		period:   quota.Period,
+		location: quota.Location,
+	}
+	res := l.dispatch(req)
+	return res.result, res.err
+}
+
+// Wait consumes count tokens like Post, but when the limit is reached it
+// sleeps until the bucket has refilled enough and tries again.
+func (l *core) Wait(ctx context.Context, key string, count, limit int64, duration time.Duration, opts Options) (Result, error) {
+
+	err := checkPostArgs(key, count, limit, opts.Burst, duration)
+
+	if err != nil {
+		return Result{}, err
+	}
+
+	return wait(ctx, func() response {
+		req := request{
+			ctx:       ctx,
+			method:    POST,
+			algorithm: opts.Algorithm,
+			key:       key,
+			count:     count,
+			limit:     limit,
+			burst:     opts.Burst,
+			duration:  duration,
+		}
+		return l.dispatch(req)
+	})
+}
+
+// Reserve consumes count tokens like Post and returns a reservation for
+// them that can later be committed or cancelled.
+func (l *core) Reserve(ctx context.Context, key string, count, limit int64, duration time.Duration, opts Options) (*Reservation, error) {
+	result, err := l.PostContext(ctx, key, count, limit, duration, opts)
+	if err != nil {
+		return nil, err
+	}
+	return l.reservations.add(key, opts.Algorithm, count, result.Used)
+}
+
+// Commit closes the reservation and keeps its tokens consumed.
+func (l *core) Commit(id string) error {
+	_, err := l.reservations.take(id)
+	return err
+}
+
+// Cancel closes the reservation and refunds its tokens.
+func (l *core) Cancel(ctx context.Context, id string) error {
+	reservation, err := l.reservations.take(id)
+	if err != nil {
+		return err
+	}
+	_, err = l.RefundContext(ctx, reservation.Key, reservation.Count, Options{Algorithm: reservation.Algorithm})
+	if err == ErrNotFound {
+		// The bucket expired, so its tokens are back already
+		return nil
+	}
+	return err
 }
 
-func (l *SingleThreadLimiter) Post(key string, count, limit int64, duration time.Duration) (int64, error) {
+// Acquire takes one of the limit concurrent slots of key for at most ttl.
+// The lease has to be released when the caller is done, or it frees its
+// slot when it expires.
+func (l *core) Acquire(ctx context.Context, key string, limit int64, ttl time.Duration) (*Lease, Result, error) {
+	if err := checkAcquireArgs(key, limit, ttl); err != nil {
+		return nil, Result{}, err
+	}
+	req := request{
+		ctx:      ctx,
+		method:   ACQUIRE,
+		key:      key,
+		limit:    limit,
+		duration: ttl,
+	}
+	res := l.dispatch(req)
+	return res.lease, res.result, res.err
+}
+
+// Release frees the slot of the lease id of key.
+func (l *core) Release(ctx context.Context, key, id string) error {
+	if err := checkReleaseArgs(key, id); err != nil {
+		return err
+	}
+	req := request{
+		ctx:    ctx,
+		method: RELEASE,
+		key:    key,
+		id:     id,
+	}
+	return l.dispatch(req).err
+}
+
+func (l *core) Refund(key string, count int64) (Result, error) {
+	return l.RefundContext(context.Background(), key, count, Options{})
+}
+
+// RefundContext gives count tokens back to the bucket of key, for example
+// after consuming more than was eventually needed.
+func (l *core) RefundContext(ctx context.Context, key string, count int64, opts Options) (Result, error) {
 
-	err := checkPostArgs(key, count, limit, duration)
+	err := checkCountArgs(key, count)
 
 	if err != nil {
-		return 0, err
+		return Result{}, err
 	}
 
 	req := request{
-		POST,
-		key,
-		count,
-		limit,
-		duration,
-		make(chan response),
+		ctx:       ctx,
+		method:    REFUND,
+		algorithm: opts.Algorithm,
+		key:       key,
+		count:     count,
 	}
-	l.reqChan <- req
-	res := <-req.response
-	return res.used, res.err
+	res := l.dispatch(req)
+	return res.result, res.err
 }
 
-func (l *SingleThreadLimiter) Get(key string) (int64, error) {
+func (l *core) GetContext(ctx context.Context, key string, opts Options) (Result, error) {
 	req := request{
-		GET,
-		key,
-		0,
-		0,
-		0,
-		make(chan response),
+		ctx:       ctx,
+		method:    GET,
+		algorithm: opts.Algorithm,
+		key:       key,
 	}
-	l.reqChan <- req
-	res := <-req.response
-	return res.used, res.err
+	res := l.dispatch(req)
+	return res.result, res.err
 }
 
-func (l *SingleThreadLimiter) Delete(key string) error {
+// GetResult returns the usage of key and how long it takes until count
+// more tokens are available, without consuming them.
+func (l *core) GetResult(ctx context.Context, key string, count int64, opts Options) (Result, error) {
+
+	err := checkCountArgs(key, count)
+
+	if err != nil {
+		return Result{}, err
+	}
+
+	req := request{
+		ctx:       ctx,
+		method:    GET,
+		algorithm: opts.Algorithm,
+		key:       key,
+		count:     count,
+	}
+	res := l.dispatch(req)
+	return res.result, res.err
+}
+
+func (l *core) DeleteContext(ctx context.Context, key string, opts Options) error {
 	req := request{
-		DELETE,
-		key,
-		0,
-		0,
-		0,
-		make(chan response),
-	}
-	l.reqChan <- req
-	res := <-req.response
+		ctx:       ctx,
+		method:    DELETE,
+		algorithm: opts.Algorithm,
+		key:       key,
+	}
+	res := l.dispatch(req)
 	return res.err
 }
 
+type SingleThreadLimiter struct {
+	core
+	reqChan  chan request
+	stopChan chan int
+	doneChan chan int
+}
+
+func NewSingleThreadLimiter(storage Storage) *SingleThreadLimiter {
+	l := &SingleThreadLimiter{
+		core:     newCore(storage),
+		reqChan:  make(chan request),
+		stopChan: make(chan int),
+		doneChan: make(chan int),
+	}
+	l.dispatch = l.send
+	return l
+}
+
+func (l *SingleThreadLimiter) Start() {
+	go l.serve()
+}
+
+func (l *SingleThreadLimiter) Stop() {
+	l.Shutdown(context.Background())
+}
+
+// Shutdown stops accepting requests, lets the ones already in flight
+// finish and then stops the serve goroutine. New requests fail with
+// ErrStopped. If ctx is done first, Shutdown returns its error and the
+// remaining requests keep draining in the background.
+func (l *SingleThreadLimiter) Shutdown(ctx context.Context) error {
+	if l.inflight.close() {
+		go func() {
+			l.inflight.wait()
+			close(l.stopChan)
+		}()
+	}
+	select {
+	case <-l.doneChan:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// send queues req for the serve goroutine and waits for its response.
+// It gives up as soon as the request context is done; the response
+// channel is buffered so serve never blocks on an abandoned request.
+func (l *SingleThreadLimiter) send(req request) response {
+	if !l.inflight.enter() {
+		return response{err: ErrStopped}
+	}
+	defer l.inflight.leave()
+	req.response = make(chan response, 1)
+	select {
+	case l.reqChan <- req:
+	case <-req.ctx.Done():
+		return response{err: req.ctx.Err()}
+	}
+	select {
+	case res := <-req.response:
+		return res
+	case <-req.ctx.Done():
+		return response{err: req.ctx.Err()}
+	}
+}
+
 func (l *SingleThreadLimiter) serve() {
 	for {
 		select {
 		case _ = <-l.stopChan:
-			break
+			close(l.doneChan)
+			return
 		case req := <-l.reqChan:
-			switch req.method {
-			case GET:
-				bucket, err := l.storage.Get(req.key)
-				if err != nil {
-					req.response <- response{0, err}
-					continue
-				}
-				if bucket == nil {
-					req.response <- response{0, ErrNotFound}
-					continue
-				}
-
-				now := time.Now()
-				req.response <- response{usage(bucket.GetAdjustedUsage(now)), nil}
-			case DELETE:
-				err := l.storage.Delete(req.key)
-				req.response <- response{0, err}
-			case POST:
-				bucket, err := l.storage.Get(req.key)
-				if err != nil {
-					req.response <- response{0, err}
-					continue
-				}
-
-				count, limit := float64(req.count), float64(req.limit)
-				duration := req.duration
-
-				if bucket == nil {
-					bucket = NewTokenBucket(limit, duration)
-				} else if bucket.Limit != limit || bucket.Duration != duration {
-					bucket = NewTokenBucket(limit, duration)
-				}
-
-				err = bucket.Consume(count)
-				if err != nil {
-					req.response <- response{usage(bucket.Used), err}
-					continue
-				}
-				err = l.storage.Set(req.key, bucket, duration)
-				if err != nil {
-					req.response <- response{0, err}
-					continue
-				}
-				req.response <- response{usage(bucket.Used), nil}
-			default:
-				req.response <- response{0, errors.New("Undefined Method")}
-				continue
-			}
+			req.response <- handle(l.storage, l.settings, req)
+		}
+	}
+}
+
+// wait calls post until it succeeds or fails with anything other than
+// ErrLimitReached, sleeping in between for the time the bucket reported.
+// If ctx has a deadline that ends before the tokens are available, wait
+// gives up right away with ErrLimitReached instead of sleeping in vain.
+func wait(ctx context.Context, post func() response) (Result, error) {
+	for {
+		res := post()
+		if res.err != ErrLimitReached {
+			return res.result, res.err
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(res.result.RetryAfter).After(deadline) {
+			return res.result, res.err
+		}
+		timer := time.NewTimer(res.result.RetryAfter)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return res.result, ctx.Err()
+		}
+	}
+}
+
+// inflight tracks the requests running in a limiter so that it can
+// refuse new ones and wait for the rest during shutdown.
+type inflight struct {
+	mu      sync.RWMutex
+	closed  bool
+	pending sync.WaitGroup
+}
+
+func (f *inflight) enter() bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.closed {
+		return false
+	}
+	f.pending.Add(1)
+	return true
+}
+
+func (f *inflight) leave() {
+	f.pending.Done()
+}
+
+// close refuses further requests. It reports whether this call was the
+// one that closed f.
+func (f *inflight) close() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return false
+	}
+	f.closed = true
+	return true
+}
+
+func (f *inflight) isClosed() bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.closed
+}
+
+func (f *inflight) wait() {
+	f.pending.Wait()
+}
+
+// settings are what limiters handle requests with besides the storage.
+type settings struct {
+	clock     Clock
+	migration Migration
+	// location aligns the windows of AlgorithmFixedWindow, nil aligns
+	// them to the Unix epoch
+	location *time.Location
+}
+
+// startedContext is the context of a request that a limiter started to
+// handle, without its cancellation. Calls to network storages cannot be
+// called off once sent, so a request runs all of its storage calls to the
+// end, and its keys stay serialized until their writes have landed.
+type startedContext struct {
+	context.Context
+}
+
+func (startedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (startedContext) Done() <-chan struct{}       { return nil }
+func (startedContext) Err() error                  { return nil }
+
+// handle runs a single request against the storage with its algorithm,
+// with the state of keys brought up to the time of the
+// settings' clock. Callers are responsible for serializing requests that
+// share the same key until handle returns, and may stop waiting for it
+// once the context of the request is done.
+func handle(storage Storage, settings settings, req request) response {
+	if err := req.ctx.Err(); err != nil {
+		return response{err: err}
+	}
+	req.ctx = startedContext{req.ctx}
+	now := settings.clock.Now()
+	switch req.method {
+	case MULTI:
+		return handleMulti(storage, settings, now, req)
+	case WINDOWS:
+		return handleWindows(storage, settings, now, req)
+	case GET, POST:
+		if req.period != "" {
+			return handleQuota(storage, settings, now, req)
+		}
+	case ACQUIRE:
+		return handleAcquire(storage, now, req)
+	case RELEASE:
+		return handleRelease(storage, now, req)
+	}
+	alg, err := lookupBurstAlgorithm(req.algorithm, req.burst)
+	if err != nil {
+		return response{err: err}
+	}
+	switch req.method {
+	case GET:
+		return alg.get(storage, settings, now, req)
+	case DELETE:
+		return alg.remove(storage, settings, now, req)
+	case POST, PEEK:
+		return alg.post(storage, settings, now, req, req.method == PEEK)
+	case REFUND:
+		return alg.refund(storage, settings, now, req)
+	case CHARGE:
+		bucketAlg, ok := alg.(tokenBucketAlgorithm)
+		if !ok {
+			return response{err: ErrDebtAlgorithm}
 		}
+		return bucketAlg.charge(storage, settings, now, req)
+	}
+	return response{err: errors.New("Undefined Method")}
+}
+
+// postBucket returns the bucket a POST consumes from. A bucket whose limit,
+// burst or duration differs from the request is migrated to the new ones.
+func postBucket(bucket *TokenBucket, limit, burst int64, duration time.Duration, migration Migration, now time.Time) *TokenBucket {
+	if bucket == nil {
+		bucket = NewTokenBucketAt(limit, duration, now)
+		bucket.Burst = burst
+	} else if bucket.Limit != limit || bucket.Burst != burst || bucket.Duration != duration {
+		bucket.MigrateBurst(limit, burst, duration, migration, now)
 	}
+	return bucket
 }
 
-func checkPostArgs(key string, count, limit int64, duration time.Duration) error {
+func checkPostArgs(key string, count, limit, burst int64, duration time.Duration) error {
+	capacity := limit
+	if burst > 0 {
+		capacity = burst
+	}
 	switch true {
 	case len(strings.TrimSpace(key)) == 0:
 		return ErrKeyEmpty
@@ -154,7 +696,11 @@ func checkPostArgs(key string, count, limit int64, duration time.Duration) error
 		return ErrCountZero
 	case limit <= 0:
 		return ErrLimitZero
-	case count > limit:
+	case burst < 0:
+		return ErrBurstNegative
+	case capacity > MaxTokens || limit > MaxTokens:
+		return ErrLimitTooLarge
+	case count > capacity:
 		return ErrCountLimit
 	case duration == 0:
 		return ErrZeroDuration
@@ -162,23 +708,55 @@ func checkPostArgs(key string, count, limit int64, duration time.Duration) error
 	return nil
 }
 
+func checkCountArgs(key string, count int64) error {
+	switch true {
+	case len(strings.TrimSpace(key)) == 0:
+		return ErrKeyEmpty
+	case count <= 0:
+		return ErrCountZero
+	}
+	return nil
+}
+
 type response struct {
-	used int64
-	err  error
+	result Result
+	multi  []Result
+	// binding is the index of the binding window of a WINDOWS request
+	binding int
+	lease   *Lease
+	err     error
 }
 
 const (
 	GET = iota
 	POST
 	DELETE
+	REFUND
+	MULTI
+	PEEK
+	ACQUIRE
+	RELEASE
+	WINDOWS
+	CHARGE
 )
 
 type request struct {
+	ctx      context.Context
 	method   int
 	key      string
 	count    int64
 	limit    int64
+	burst    int64
 	duration time.Duration
+	// algorithm is the name of the algorithm of the request, empty for
+	// the token bucket
+	algorithm string
+	items     []PostItem
+	windows   []Window
+	id        string
+	// period and location are set for the requests of a Quota
+	period   string
+	location *time.Location
 	response chan response
 }
 
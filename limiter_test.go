@@ -1,6 +1,7 @@
 package ratelimit
 
 import (
+	"context"
 	"testing"
 	"time"
 )
@@ -11,27 +12,27 @@ func TestLimiterPost(t *testing.T) {
 	limiter := NewSingleThreadLimiter(storage)
 	limiter.Start()
 	defer limiter.Stop()
-	used, err := limiter.Post("testkey1", 1, 10, duration)
+	result, err := limiter.Post("testkey1", 1, 10, duration)
 	if err != nil {
 		t.Error(err)
 	}
-	bucket, _ := storage.Get("testkey1")
+	bucket, _ := storage.Get(context.Background(), "testkey1")
 	t.Log(bucket)
-	if used != 1 {
-		t.Error("There should be 1 token used", used)
+	if result.Used != 1 {
+		t.Error("There should be 1 token used", result.Used)
 	}
 
-	used, err = limiter.Post("testkey1", 1, 10, duration)
+	result, err = limiter.Post("testkey1", 1, 10, duration)
 	if err != nil {
 		t.Error(err)
 	}
 	t.Log(bucket)
-	if used != 2 {
-		t.Error("There should be 2 token used", used)
+	if result.Used != 2 {
+		t.Error("There should be 2 token used", result.Used)
 	}
-	used, _ = limiter.Get("testkey1")
-	if used != 2 {
-		t.Error("There should be 2 token used", used)
+	result, _ = limiter.Get("testkey1")
+	if result.Used != 2 {
+		t.Error("There should be 2 token used", result.Used)
 	}
 }
 
@@ -39,41 +40,73 @@ func TestLimiterPost(t *testing.T) {
 func TestLimiterEverySecondForMax5In10Seconds(t *testing.T) {
 	storage := NewDummyStorage()
 	duration := time.Second * 10
+	clock := NewFakeClock(time.Now())
 	limiter := NewSingleThreadLimiter(storage)
+	limiter.SetClock(clock)
 	limiter.Start()
 	defer limiter.Stop()
-	used, err := limiter.Post("testkey1", 1, 5, duration)
+	result, err := limiter.Post("testkey1", 1, 5, duration)
 	if err != nil {
 		t.Error(err)
 	}
-	if used != 1 {
-		t.Error("There should be 1 token used", used)
+	if result.Used != 1 {
+		t.Error("There should be 1 token used", result.Used)
 	}
 
-	bucket, _ := storage.Get("testkey1")
-	bucket.LastAccessTime = bucket.LastAccessTime.Add(-time.Second)
-	used, err = limiter.Post("testkey1", 1, 5, duration)
+	clock.Advance(time.Second)
+	result, err = limiter.Post("testkey1", 1, 5, duration)
 	if err != nil {
 		t.Error(err)
 	}
-	if used != 2 {
-		t.Error("There should be 2 token used", used)
+	if result.Used != 2 {
+		t.Error("There should be 2 token used", result.Used)
 	}
-	bucket.LastAccessTime = bucket.LastAccessTime.Add(-time.Second)
-	used, err = limiter.Post("testkey1", 1, 5, duration)
+	clock.Advance(time.Second)
+	result, err = limiter.Post("testkey1", 1, 5, duration)
 	if err != nil {
 		t.Error(err)
 	}
-	if used != 2 {
-		t.Error("There should be 2 token used", used)
+	if result.Used != 2 {
+		t.Error("There should be 2 token used", result.Used)
 	}
-	bucket.LastAccessTime = bucket.LastAccessTime.Add(-time.Second)
-	used, err = limiter.Post("testkey1", 1, 5, duration)
+	clock.Advance(time.Second)
+	result, err = limiter.Post("testkey1", 1, 5, duration)
 	if err != nil {
 		t.Error(err)
 	}
-	if used != 3 {
-		t.Error("There should be 3 token used", used)
+	if result.Used != 3 {
+		t.Error("There should be 3 token used", result.Used)
+	}
+}
+
+func TestLimiterFakeClockRefill(t *testing.T) {
+	storage := NewDummyStorage()
+	duration := time.Second * 100
+	clock := NewFakeClock(time.Now())
+	limiter := NewSingleThreadLimiter(storage)
+	limiter.SetClock(clock)
+	limiter.Start()
+	defer limiter.Stop()
+	limiter.Post("testkey1", 10, 10, duration)
+	_, err := limiter.Post("testkey1", 5, 10, duration)
+	if err != ErrLimitReached {
+		t.Error("Error should be ErrLimitReached", err)
+	}
+	clock.Advance(time.Second * 49)
+	result, err := limiter.Post("testkey1", 5, 10, duration)
+	if err != ErrLimitReached {
+		t.Error("Error should be ErrLimitReached", err)
+	}
+	if result.RetryAfter != time.Second {
+		t.Error("RetryAfter should be 1s", result.RetryAfter)
+	}
+	clock.Advance(time.Second)
+	result, err = limiter.Post("testkey1", 5, 10, duration)
+	if err != nil {
+		t.Error(err)
+	}
+	if !result.Reset.Equal(clock.Now().Add(duration)) {
+		t.Error("Bucket should be full again after a whole duration", result.Reset)
 	}
 }
 
@@ -99,8 +132,8 @@ func TestLimiterGet(t *testing.T) {
 	storage := NewDummyStorage()
 	duration := time.Second * 100
 	lastAccessTime := time.Now().Add(-duration)
-	bucket := &TokenBucket{2, lastAccessTime, 10, duration}
-	storage.Set("testkey1", bucket, 0)
+	bucket := &TokenBucket{2 * Token, lastAccessTime, 10, duration, 0, 0}
+	storage.Set(context.Background(), "testkey1", bucket, 0)
 	limiter := NewSingleThreadLimiter(storage)
 	limiter.Start()
 	defer limiter.Stop()
@@ -108,11 +141,11 @@ func TestLimiterGet(t *testing.T) {
 	if err != ErrNotFound {
 		t.Error("Should return Not Found error", err)
 	}
-	used, _ := limiter.Get("testkey1")
-	if used != 0 {
-		t.Error("There should be 0 token used", used)
+	result, _ := limiter.Get("testkey1")
+	if result.Used != 0 {
+		t.Error("There should be 0 token used", result.Used)
 	}
-	if bucket.Used != 2 {
+	if bucket.Used != 2*Token {
 		t.Error("Bucket Used shouldn't change")
 	}
 	if bucket.LastAccessTime != lastAccessTime {
@@ -138,7 +171,8 @@ func TestLimiterMulti(t *testing.T) {
 		}()
 		go func() {
 			_, err := limiter.Get("testkey1")
-			if err != nil {
+			// Get may run before the first Post creates the bucket
+			if err != nil && err != ErrNotFound {
 				t.Error(err)
 			}
 			sem <- 1
@@ -149,8 +183,8 @@ func TestLimiterMulti(t *testing.T) {
 		<-sem
 	}
 
-	bucket, _ := storage.Get("testkey1")
-	if usage(bucket.Used) != 5 {
+	bucket, _ := storage.Get(context.Background(), "testkey1")
+	if bucket.Used.Ceil() != 5 {
 		t.Error("Used should be 5", bucket)
 	}
 }
@@ -163,8 +197,8 @@ func TestLimiterDelete(t *testing.T) {
 	defer limiter.Stop()
 
 	limiter.Post("testkey1", 1, 10, duration)
-	used, _ := limiter.Get("testkey1")
-	if used != 1 {
+	result, _ := limiter.Get("testkey1")
+	if result.Used != 1 {
 		t.Error("There should be 1 token used")
 	}
 	err := limiter.Delete("testkey1")
@@ -172,8 +206,380 @@ func TestLimiterDelete(t *testing.T) {
 		t.Error(err)
 	}
 
-	used, _ = limiter.Get("testkey1")
-	if used != 0 {
+	result, _ = limiter.Get("testkey1")
+	if result.Used != 0 {
 		t.Error("There should be 0 token used")
 	}
 }
+
+// blockingStorage answers long after the requests of the tests time out.
+// Limiters wait for it all the same, since calls cannot be called off.
+type blockingStorage struct{}
+
+const blockingDelay = time.Millisecond * 100
+
+func (blockingStorage) Get(_ context.Context, _ string) (*TokenBucket, error) {
+	time.Sleep(blockingDelay)
+	return nil, nil
+}
+
+func (blockingStorage) Set(_ context.Context, _ string, _ *TokenBucket, _ time.Duration) error {
+	time.Sleep(blockingDelay)
+	return nil
+}
+
+func (blockingStorage) Delete(_ context.Context, _ string) error {
+	time.Sleep(blockingDelay)
+	return nil
+}
+
+func TestLimiterContextCanceled(t *testing.T) {
+	storage := NewDummyStorage()
+	limiter := NewSingleThreadLimiter(storage)
+	limiter.Start()
+	defer limiter.Stop()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := limiter.PostContext(ctx, "testkey1", 1, 10, time.Second, Options{})
+	if err != context.Canceled {
+		t.Error("Error should be context.Canceled", err)
+	}
+	bucket, _ := storage.Get(context.Background(), "testkey1")
+	if bucket != nil {
+		t.Error("Canceled request shouldn't reach the storage", bucket)
+	}
+}
+
+func TestLimiterContextDeadline(t *testing.T) {
+	limiter := NewSingleThreadLimiter(blockingStorage{})
+	limiter.Start()
+	defer limiter.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	_, err := limiter.GetContext(ctx, "testkey1", Options{})
+	if err != context.DeadlineExceeded {
+		t.Error("Error should be context.DeadlineExceeded", err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	_, err = limiter.PostContext(ctx, "testkey1", 1, 10, time.Second, Options{})
+	if err != context.DeadlineExceeded {
+		t.Error("Error should be context.DeadlineExceeded", err)
+	}
+}
+
+// gatedStorage holds every Get until the test releases it.
+type gatedStorage struct {
+	*DummyStorage
+	entered chan int
+	release chan int
+}
+
+func (g *gatedStorage) Get(ctx context.Context, key string) (*TokenBucket, error) {
+	g.entered <- 1
+	<-g.release
+	return g.DummyStorage.Get(ctx, key)
+}
+
+func TestLimiterShutdown(t *testing.T) {
+	storage := &gatedStorage{NewDummyStorage(), make(chan int), make(chan int)}
+	limiter := NewSingleThreadLimiter(storage)
+	limiter.Start()
+	posted := make(chan error)
+	go func() {
+		_, err := limiter.Post("testkey1", 1, 10, time.Second*100)
+		posted <- err
+	}()
+	<-storage.entered
+
+	stopped := make(chan error)
+	go func() {
+		stopped <- limiter.Shutdown(context.Background())
+	}()
+	// Wait until Shutdown refuses new requests
+	for !limiter.inflight.isClosed() {
+		time.Sleep(time.Millisecond)
+	}
+	_, err := limiter.Get("testkey2")
+	if err != ErrStopped {
+		t.Error("Error should be ErrStopped", err)
+	}
+
+	select {
+	case err := <-stopped:
+		t.Error("Shutdown shouldn't return before the queue is drained", err)
+	default:
+	}
+	storage.release <- 1
+	if err := <-posted; err != nil {
+		t.Error("In-flight request should be served", err)
+	}
+	if err := <-stopped; err != nil {
+		t.Error(err)
+	}
+	bucket, _ := storage.DummyStorage.Get(context.Background(), "testkey1")
+	if bucket == nil || bucket.Used.Ceil() != 1 {
+		t.Error("In-flight request should be written to storage", bucket)
+	}
+}
+
+func TestLimiterShutdownTimeout(t *testing.T) {
+	storage := &gatedStorage{NewDummyStorage(), make(chan int), make(chan int)}
+	limiter := NewSingleThreadLimiter(storage)
+	limiter.Start()
+	go limiter.Get("testkey1")
+	<-storage.entered
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	err := limiter.Shutdown(ctx)
+	if err != context.DeadlineExceeded {
+		t.Error("Error should be context.DeadlineExceeded", err)
+	}
+	storage.release <- 1
+	limiter.Stop()
+}
+
+func TestLimiterWait(t *testing.T) {
+	storage := NewDummyStorage()
+	duration := time.Millisecond * 100
+	limiter := NewSingleThreadLimiter(storage)
+	limiter.Start()
+	defer limiter.Stop()
+	_, err := limiter.Post("testkey1", 10, 10, duration)
+	if err != nil {
+		t.Error(err)
+	}
+	start := time.Now()
+	result, err := limiter.Wait(context.Background(), "testkey1", 5, 10, duration, Options{})
+	if err != nil {
+		t.Error(err)
+	}
+	if elapsed := time.Since(start); elapsed < duration/2 {
+		t.Error("Wait should block until 5 tokens are refilled", elapsed)
+	}
+	if result.Used != 10 {
+		t.Error("There should be 10 token used", result.Used)
+	}
+}
+
+func TestLimiterWaitDeadline(t *testing.T) {
+	storage := NewDummyStorage()
+	duration := time.Second * 100
+	limiter := NewSingleThreadLimiter(storage)
+	limiter.Start()
+	defer limiter.Stop()
+	limiter.Post("testkey1", 10, 10, duration)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	start := time.Now()
+	_, err := limiter.Wait(ctx, "testkey1", 1, 10, duration, Options{})
+	if err != ErrLimitReached {
+		t.Error("Error should be ErrLimitReached", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Millisecond*500 {
+		t.Error("Wait shouldn't sleep past its deadline", elapsed)
+	}
+}
+
+func TestLimiterRefund(t *testing.T) {
+	storage := NewDummyStorage()
+	duration := time.Second * 100
+	limiter := NewSingleThreadLimiter(storage)
+	limiter.Start()
+	defer limiter.Stop()
+	_, err := limiter.Refund("testkey1", 1)
+	if err != ErrNotFound {
+		t.Error("Should return Not Found error", err)
+	}
+	limiter.Post("testkey1", 10, 10, duration)
+	result, err := limiter.Refund("testkey1", 7)
+	if err != nil {
+		t.Error(err)
+	}
+	if result.Used != 3 {
+		t.Error("There should be 3 token used", result.Used)
+	}
+	result, err = limiter.Refund("testkey1", 7)
+	if err != nil {
+		t.Error(err)
+	}
+	if result.Used != 0 {
+		t.Error("Used cannot go below zero", result.Used)
+	}
+	_, err = limiter.Refund("testkey1", 0)
+	if err != ErrCountZero {
+		t.Error("Error should be ErrCountZero", err)
+	}
+	_, err = limiter.Post("testkey1", 10, 10, duration)
+	if err != nil {
+		t.Error("Refunded tokens should be available again", err)
+	}
+}
+
+func TestLimiterPeek(t *testing.T) {
+	storage := NewDummyStorage()
+	duration := time.Second * 100
+	limiter := NewSingleThreadLimiter(storage)
+	limiter.Start()
+	defer limiter.Stop()
+	result, err := limiter.Peek(context.Background(), "testkey1", 3, 10, duration, Options{})
+	if err != nil {
+		t.Error(err)
+	}
+	if result.Used != 3 {
+		t.Error("There should be 3 token used", result.Used)
+	}
+	_, err = limiter.Get("testkey1")
+	if err != ErrNotFound {
+		t.Error("Peek shouldn't create the bucket", err)
+	}
+	limiter.Post("testkey1", 8, 10, duration)
+	result, err = limiter.Peek(context.Background(), "testkey1", 2, 10, duration, Options{})
+	if err != nil {
+		t.Error(err)
+	}
+	if result.Used != 10 {
+		t.Error("There should be 10 token used", result.Used)
+	}
+	_, err = limiter.Peek(context.Background(), "testkey1", 3, 10, duration, Options{})
+	if err != ErrLimitReached {
+		t.Error("Error should be ErrLimitReached", err)
+	}
+	result, _ = limiter.Get("testkey1")
+	if result.Used != 8 {
+		t.Error("Peek shouldn't consume tokens", result.Used)
+	}
+}
+
+func TestLimiterRetryAfter(t *testing.T) {
+	storage := NewDummyStorage()
+	duration := time.Second * 100
+	limiter := NewSingleThreadLimiter(storage)
+	limiter.Start()
+	defer limiter.Stop()
+	limiter.Post("testkey1", 10, 10, duration)
+	result, err := limiter.PostContext(context.Background(), "testkey1", 5, 10, duration, Options{})
+	if err != ErrLimitReached {
+		t.Error("Error should be ErrLimitReached", err)
+	}
+	if result.RetryAfter < time.Second*49 || result.RetryAfter > time.Second*50 {
+		t.Error("RetryAfter should be about 50s", result.RetryAfter)
+	}
+	result, err = limiter.GetResult(context.Background(), "testkey1", 1, Options{})
+	if err != nil {
+		t.Error(err)
+	}
+	if result.Used != 10 {
+		t.Error("There should be 10 token used", result.Used)
+	}
+	if result.RetryAfter < time.Second*9 || result.RetryAfter > time.Second*10 {
+		t.Error("RetryAfter should be about 10s", result.RetryAfter)
+	}
+	limiter.Refund("testkey1", 5)
+	result, _ = limiter.GetResult(context.Background(), "testkey1", 1, Options{})
+	if result.RetryAfter != 0 {
+		t.Error("RetryAfter should be zero when tokens are available", result.RetryAfter)
+	}
+}
+
+func TestLimiterResult(t *testing.T) {
+	storage := NewDummyStorage()
+	duration := time.Second * 100
+	limiter := NewSingleThreadLimiter(storage)
+	limiter.Start()
+	defer limiter.Stop()
+	before := time.Now()
+	result, err := limiter.Post("testkey1", 4, 10, duration)
+	if err != nil {
+		t.Error(err)
+	}
+	if result.Used != 4 || result.Remaining != 6 || result.Limit != 10 || result.Window != duration {
+		t.Error("Result is wrong", result)
+	}
+	if reset := result.Reset.Sub(before); reset < time.Second*39 || reset > time.Second*41 {
+		t.Error("Bucket should be full again in about 40s", reset)
+	}
+	if result.RetryAfter != 0 {
+		t.Error("RetryAfter should be zero after a successful Post", result.RetryAfter)
+	}
+	result, err = limiter.Post("testkey1", 8, 10, duration)
+	if err != ErrLimitReached {
+		t.Error("Error should be ErrLimitReached", err)
+	}
+	if result.Used != 4 || result.Remaining != 6 {
+		t.Error("Rejected Post should report the current usage", result)
+	}
+}
+
+func TestLimiterLimitChange(t *testing.T) {
+	storage := NewDummyStorage()
+	duration := time.Second * 100
+	clock := NewFakeClock(time.Now())
+	limiter := NewSingleThreadLimiter(storage)
+	limiter.SetClock(clock)
+	limiter.Start()
+	defer limiter.Stop()
+	limiter.Post("testkey1", 10, 10, duration)
+	result, err := limiter.Post("testkey1", 1, 11, duration)
+	if err != nil {
+		t.Error(err)
+	}
+	if result.Used != 11 {
+		t.Error("Changing the limit shouldn't reset the usage", result.Used)
+	}
+	_, err = limiter.Post("testkey1", 1, 11, time.Second)
+	if err != ErrLimitReached {
+		t.Error("Changing the duration shouldn't reset the usage", err)
+	}
+
+	limiter = NewSingleThreadLimiter(storage)
+	limiter.SetClock(clock)
+	limiter.SetMigration(Rescale)
+	limiter.Start()
+	defer limiter.Stop()
+	limiter.Post("testkey2", 10, 10, duration)
+	_, err = limiter.Post("testkey2", 1, 11, duration)
+	if err != ErrLimitReached {
+		t.Error("A full bucket should stay full when rescaled", err)
+	}
+}
+
+func TestLimiterBurst(t *testing.T) {
+	storage := NewDummyStorage()
+	clock := NewFakeClock(time.Now())
+	limiter := NewShardedLimiter(storage, 4)
+	limiter.SetClock(clock)
+	ctx := context.Background()
+	burst := Options{Burst: 50}
+	result, err := limiter.PostContext(ctx, "testkey1", 30, 10, time.Second, burst)
+	if err != nil || result.Remaining != 20 || result.Burst != 50 || result.Limit != 10 {
+		t.Error("Posts should take up to the burst", result, err)
+	}
+	if _, err := limiter.PostContext(ctx, "testkey1", 51, 10, time.Second, burst); err != ErrCountLimit {
+		t.Error("Count cannot exceed the burst", err)
+	}
+	if _, err := limiter.PostContext(ctx, "testkey1", 1, 10, time.Second, Options{Burst: -1}); err != ErrBurstNegative {
+		t.Error("Burst cannot be negative", err)
+	}
+	result, err = limiter.PostContext(ctx, "testkey1", 21, 10, time.Second, burst)
+	if err != ErrLimitReached || result.RetryAfter != time.Millisecond*100 {
+		t.Error("The burst should refill at the limit", result, err)
+	}
+	if bucket, _ := storage.Get(context.Background(), "testkey1"); bucket.Burst != 50 {
+		t.Error("Burst should be stored with the bucket", bucket)
+	}
+	// Without a burst the bucket shrinks back to its limit
+	result, err = limiter.PostContext(ctx, "testkey1", 1, 10, time.Second, Options{})
+	if err != ErrLimitReached || result.Burst != 10 {
+		t.Error("The bucket should hold its limit again", result, err)
+	}
+
+	gcra := Options{Algorithm: AlgorithmGCRA, Burst: 50}
+	if _, err := limiter.PostContext(ctx, "testkey2", 1, 10, time.Second, gcra); err != ErrBurstAlgorithm {
+		t.Error("Only the token bucket has a burst", err)
+	}
+	items := []PostItem{{"testkey3", 20, 10, time.Second, AlgorithmTokenBucket, 20}}
+	if results, err := limiter.PostMulti(context.Background(), items); err != nil || results[0].Remaining != 0 {
+		t.Error("Items should take up to their burst", results, err)
+	}
+}
@@ -1,8 +1,10 @@
 package ratelimit
 
 import (
-	"bytes"
-	"encoding/gob"
+	"context"
+	"fmt"
+	"math"
+	"strconv"
 	"time"
 )
 
@@ -23,34 +25,243 @@ func NewMemcacheStorage(client *memcache.Client, prefix string) *MemcacheStorage
 	return &MemcacheStorage{client, prefix}
 }
 
-func (ms *MemcacheStorage) Get(key string) (*TokenBucket, error) {
-	item, err := ms.client.Get(ms.prefix + key)
+func (ms *MemcacheStorage) Get(ctx context.Context, key string) (*TokenBucket, error) {
+	var item *memcache.Item
+	err := withContext(ctx, func() error {
+		var err error
+		item, err = ms.client.Get(ms.prefix + key)
+		return err
+	})
 	if err == memcache.ErrCacheMiss {
 		return nil, nil
 	} else if err != nil {
 		return nil, err
 	}
-	var bucket = new(TokenBucket)
-	dec := gob.NewDecoder(bytes.NewBuffer(item.Value))
-	err = dec.Decode(bucket)
+	return decodeBucket(item.Value)
+}
+
+func (ms *MemcacheStorage) Set(ctx context.Context, key string, bucket *TokenBucket, duration time.Duration) error {
+	data, err := encodeBucket(bucket)
 	if err != nil {
+		return err
+	}
+	item := &memcache.Item{
+		Key:        ms.prefix + key,
+		Value:      data,
+		Expiration: expireSeconds(duration),
+	}
+	return withContext(ctx, func() error {
+		return ms.client.Set(item)
+	})
+}
+
+func (ms *MemcacheStorage) Delete(ctx context.Context, key string) error {
+	return withContext(ctx, func() error {
+		return ms.client.Delete(ms.prefix + key)
+	})
+}
+
+// gcraKey is where the GCRA state of key is kept, apart from its bucket.
+func (ms *MemcacheStorage) gcraKey(key string) string {
+	return ms.prefix + "gcra:" + key
+}
+
+func (ms *MemcacheStorage) GetGCRA(ctx context.Context, key string) (*GCRAState, error) {
+	var item *memcache.Item
+	err := withContext(ctx, func() error {
+		var err error
+		item, err = ms.client.Get(ms.gcraKey(key))
+		return err
+	})
+	if err == memcache.ErrCacheMiss {
+		return nil, nil
+	} else if err != nil {
 		return nil, err
 	}
-	return bucket, nil
+	return parseGCRAState(string(item.Value))
 }
 
-func (ms *MemcacheStorage) Set(key string, bucket *TokenBucket, duration time.Duration) error {
-	var buffer = bytes.NewBuffer(nil)
-	enc := gob.NewEncoder(buffer)
-	enc.Encode(bucket)
-	item := &memcache.Item{
-		Key:        ms.prefix + key,
-		Value:      buffer.Bytes(),
-		Expiration: int32(duration.Seconds()),
+// CompareAndSetGCRA adds the first state of a key and swaps the next ones
+// with the cas command of memcache, which fails if the item changed since
+// it was read.
+func (ms *MemcacheStorage) CompareAndSetGCRA(ctx context.Context, key string, old, state *GCRAState, expire time.Duration) (bool, error) {
+	var swapped bool
+	err := withContext(ctx, func() error {
+		item := &memcache.Item{
+			Key:        ms.gcraKey(key),
+			Value:      []byte(state.String()),
+			Expiration: expireSeconds(expire),
+		}
+		if old == nil {
+			err := ms.client.Add(item)
+			if err == memcache.ErrNotStored {
+				return nil
+			}
+			swapped = err == nil
+			return err
+		}
+		current, err := ms.client.Get(item.Key)
+		if err == memcache.ErrCacheMiss {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if string(current.Value) != old.String() {
+			return nil
+		}
+		current.Value, current.Expiration = item.Value, item.Expiration
+		err = ms.client.CompareAndSwap(current)
+		if err == memcache.ErrCASConflict || err == memcache.ErrNotStored {
+			return nil
+		}
+		swapped = err == nil
+		return err
+	})
+	if err != nil {
+		return false, err
 	}
-	return ms.client.Set(item)
+	return swapped, nil
 }
 
-func (ms *MemcacheStorage) Delete(key string) error {
-	return ms.client.Delete(ms.prefix + key)
+func (ms *MemcacheStorage) DeleteGCRA(ctx context.Context, key string) error {
+	err := withContext(ctx, func() error {
+		return ms.client.Delete(ms.gcraKey(key))
+	})
+	if err == memcache.ErrCacheMiss {
+		return nil
+	}
+	return err
+}
+
+// maxRelativeExpiration is the longest expiration memcache takes as
+// relative. Longer ones are taken as a Unix timestamp.
+const maxRelativeExpiration = 30 * 24 * time.Hour
+
+// expireSeconds rounds expire up to whole seconds, since an expiration of
+// zero would keep the item forever. Expirations beyond
+// maxRelativeExpiration are turned into the Unix time they end at, capped
+// at the last one memcache can take, since debts can keep buckets for
+// longer.
+func expireSeconds(expire time.Duration) int32 {
+	seconds := int64(expire / time.Second)
+	if expire%time.Second > 0 {
+		seconds++
+	}
+	if seconds > int64(maxRelativeExpiration/time.Second) {
+		at := time.Now().Unix() + seconds
+		if at > math.MaxInt32 {
+			return math.MaxInt32
+		}
+		return int32(at)
+	}
+	return int32(seconds)
+}
+
+// Every window of a key has its own counter, next to an item with the
+// limit and duration of the key.
+func (ms *MemcacheStorage) counterKey(key string, start time.Time) string {
+	return fmt.Sprintf("%swin:%s:%d", ms.prefix, key, start.UnixNano())
+}
+
+func (ms *MemcacheStorage) counterMetaKey(key string) string {
+	return ms.prefix + "winmeta:" + key
+}
+
+func (ms *MemcacheStorage) GetCounters(ctx context.Context, key string, starts []time.Time) (*Counters, error) {
+	keys := []string{ms.counterMetaKey(key)}
+	for _, start := range starts {
+		keys = append(keys, ms.counterKey(key, start))
+	}
+	var items map[string]*memcache.Item
+	err := withContext(ctx, func() error {
+		var err error
+		items, err = ms.client.GetMulti(keys)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	meta, ok := items[keys[0]]
+	if !ok {
+		return nil, nil
+	}
+	counters := &Counters{Counts: make([]int64, len(starts))}
+	var duration int64
+	if _, err := fmt.Sscanf(string(meta.Value), "%d %d", &counters.Limit, &duration); err != nil {
+		return nil, fmt.Errorf("Invalid counter meta '%s'", meta.Value)
+	}
+	counters.Duration = time.Duration(duration)
+	for i, key := range keys[1:] {
+		item, ok := items[key]
+		if !ok {
+			continue
+		}
+		counters.Counts[i], err = strconv.ParseInt(string(item.Value), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return counters, nil
+}
+
+// IncrCounter uses the native incr and decr commands of memcache, which
+// only work on existing items, so a missing counter is added first.
+func (ms *MemcacheStorage) IncrCounter(ctx context.Context, key string, start time.Time, delta, limit int64, duration, expire time.Duration) (int64, error) {
+	counterKey := ms.counterKey(key, start)
+	var count uint64
+	err := withContext(ctx, func() error {
+		var err error
+		if delta < 0 {
+			// decr never drops below zero
+			count, err = ms.client.Decrement(counterKey, uint64(-delta))
+			if err == memcache.ErrCacheMiss {
+				count, err = 0, nil
+			}
+			return err
+		}
+		count, err = ms.client.Increment(counterKey, uint64(delta))
+		if err != memcache.ErrCacheMiss {
+			return err
+		}
+		err = ms.client.Add(&memcache.Item{
+			Key:        counterKey,
+			Value:      []byte(strconv.FormatInt(delta, 10)),
+			Expiration: expireSeconds(expire),
+		})
+		if err == memcache.ErrNotStored {
+			// Someone else added it in the meantime
+			count, err = ms.client.Increment(counterKey, uint64(delta))
+			return err
+		}
+		count = uint64(delta)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	meta := &memcache.Item{
+		Key:        ms.counterMetaKey(key),
+		Value:      []byte(limitMeta(limit, duration)),
+		Expiration: expireSeconds(expire),
+	}
+	err = withContext(ctx, func() error {
+		return ms.client.Set(meta)
+	})
+	return int64(count), err
+}
+
+func (ms *MemcacheStorage) DeleteCounters(ctx context.Context, key string, starts []time.Time) error {
+	keys := []string{ms.counterMetaKey(key)}
+	for _, start := range starts {
+		keys = append(keys, ms.counterKey(key, start))
+	}
+	return withContext(ctx, func() error {
+		for _, key := range keys {
+			err := ms.client.Delete(key)
+			if err != nil && err != memcache.ErrCacheMiss {
+				return err
+			}
+		}
+		return nil
+	})
 }
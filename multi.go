@@ -0,0 +1,116 @@
+package ratelimit
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrNoItems = errors.New("At least one key is required")
+)
+
+// A PostItem is one of the keys consumed together by PostMulti.
+type PostItem struct {
+	Key      string
+	Count    int64
+	Limit    int64
+	Duration time.Duration
+	// Algorithm is one of the Algorithm constants, empty for
+	// AlgorithmTokenBucket.
+	Algorithm string
+	// Burst is the capacity of the token bucket of the key, zero for its
+	// limit. See Options.
+	Burst int64
+}
+
+// KeyError reports the key of a PostMulti item that failed, so that callers
+// can tell which of their limits rejected the request.
+type KeyError struct {
+	Key string
+	Err error
+}
+
+func (e *KeyError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Key, e.Err)
+}
+
+func checkMultiArgs(items []PostItem) error {
+	if len(items) == 0 {
+		return ErrNoItems
+	}
+	for _, item := range items {
+		err := checkPostArgs(item.Key, item.Count, item.Limit, item.Burst, item.Duration)
+		if err != nil {
+			return &KeyError{item.Key, err}
+		}
+	}
+	return nil
+}
+
+// handleMulti consumes the tokens of every item, or of none of them if any
+// item would reach its limit. Every key is checked with a dry run first
+// and nothing is consumed until all of them passed. Items that repeat a
+// key consume from the same state, with the limit of their first item.
+func handleMulti(storage Storage, settings settings, now time.Time, req request) response {
+	type target struct {
+		algorithm string
+		key       string
+	}
+	targets := make([]target, len(req.items))
+	merged := make(map[target]*request, len(req.items))
+	var order []target
+	for i, item := range req.items {
+		t := target{item.Algorithm, item.Key}
+		if t.algorithm == "" {
+			t.algorithm = AlgorithmTokenBucket
+		}
+		targets[i] = t
+		if r, ok := merged[t]; ok {
+			r.count += item.Count
+			continue
+		}
+		merged[t] = &request{
+			ctx:       req.ctx,
+			method:    POST,
+			algorithm: t.algorithm,
+			key:       item.Key,
+			count:     item.Count,
+			limit:     item.Limit,
+			burst:     item.Burst,
+			duration:  item.Duration,
+		}
+		order = append(order, t)
+	}
+	algs := make(map[target]algorithm, len(order))
+	for _, t := range order {
+		alg, err := lookupBurstAlgorithm(t.algorithm, merged[t].burst)
+		if err != nil {
+			return response{err: &KeyError{t.key, err}}
+		}
+		algs[t] = alg
+		res := alg.post(storage, settings, now, *merged[t], true)
+		if res.err == ErrLimitReached {
+			return response{result: res.result, err: &KeyError{t.key, res.err}}
+		} else if res.err != nil {
+			return res
+		}
+	}
+	// Storages have no transactions, so a failing write may still leave
+	// the items before it consumed
+	results := make(map[target]Result, len(order))
+	for _, t := range order {
+		res := algs[t].post(storage, settings, now, *merged[t], false)
+		if res.err == ErrLimitReached {
+			return response{result: res.result, err: &KeyError{t.key, res.err}}
+		} else if res.err != nil {
+			return res
+		}
+		results[t] = res.result
+	}
+	multi := make([]Result, len(req.items))
+	for i, t := range targets {
+		multi[i] = results[t]
+	}
+	return response{multi: multi}
+}
@@ -0,0 +1,111 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPostMulti(t *testing.T) {
+	storage := NewDummyStorage()
+	duration := time.Second * 100
+	limiter := NewSingleThreadLimiter(storage)
+	limiter.Start()
+	defer limiter.Stop()
+	limiter.Post("testkey2", 9, 10, duration)
+	items := []PostItem{
+		{"testkey1", 1, 10, duration, AlgorithmTokenBucket, 0},
+		{"testkey2", 1, 10, duration, AlgorithmTokenBucket, 0},
+	}
+	results, err := limiter.PostMulti(context.Background(), items)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(results) != 2 || results[0].Used != 1 || results[1].Used != 10 {
+		t.Error("Used should be 1 and 10", results)
+	}
+	results, err = limiter.PostMulti(context.Background(), items)
+	keyErr, ok := err.(*KeyError)
+	if !ok || keyErr.Key != "testkey2" || keyErr.Err != ErrLimitReached {
+		t.Error("Error should be ErrLimitReached for testkey2", err)
+	}
+	if results != nil {
+		t.Error("Rejected request shouldn't return results", results)
+	}
+	if result, _ := limiter.Get("testkey1"); result.Used != 1 {
+		t.Error("Rejected request shouldn't consume other keys", result.Used)
+	}
+}
+
+func TestPostMultiRepeatedKey(t *testing.T) {
+	storage := NewDummyStorage()
+	duration := time.Second * 100
+	limiter := NewSingleThreadLimiter(storage)
+	limiter.Start()
+	defer limiter.Stop()
+	items := []PostItem{
+		{"testkey1", 6, 10, duration, AlgorithmTokenBucket, 0},
+		{"testkey1", 6, 10, duration, AlgorithmTokenBucket, 0},
+	}
+	_, err := limiter.PostMulti(context.Background(), items)
+	if keyErr, ok := err.(*KeyError); !ok || keyErr.Err != ErrLimitReached {
+		t.Error("Error should be ErrLimitReached", err)
+	}
+	_, err = limiter.Get("testkey1")
+	if err != ErrNotFound {
+		t.Error("Rejected request shouldn't create buckets", err)
+	}
+}
+
+func TestPostMultiArgs(t *testing.T) {
+	limiter := NewSingleThreadLimiter(NewDummyStorage())
+	limiter.Start()
+	defer limiter.Stop()
+	_, err := limiter.PostMulti(context.Background(), nil)
+	if err != ErrNoItems {
+		t.Error("Error should be ErrNoItems", err)
+	}
+	items := []PostItem{
+		{"testkey1", 1, 10, time.Second, AlgorithmTokenBucket, 0},
+		{"testkey2", 0, 10, time.Second, AlgorithmTokenBucket, 0},
+	}
+	_, err = limiter.PostMulti(context.Background(), items)
+	if keyErr, ok := err.(*KeyError); !ok || keyErr.Key != "testkey2" || keyErr.Err != ErrCountZero {
+		t.Error("Error should be ErrCountZero for testkey2", err)
+	}
+}
+
+func TestShardedPostMulti(t *testing.T) {
+	storage := NewDummyStorage()
+	duration := time.Second * 100
+	limiter := NewShardedLimiter(storage, 4)
+	keys := []string{"testkey1", "testkey2", "testkey3", "testkey4"}
+	sem := make(chan int)
+
+	// Batches lock their shards in opposite orders of keys
+	for i := 0; i < 20; i++ {
+		go func(i int) {
+			items := []PostItem{
+				{keys[i%len(keys)], 1, 100, duration, AlgorithmTokenBucket, 0},
+				{keys[(i+1)%len(keys)], 1, 100, duration, AlgorithmTokenBucket, 0},
+				{keys[len(keys)-1-i%len(keys)], 1, 100, duration, AlgorithmTokenBucket, 0},
+			}
+			_, err := limiter.PostMulti(context.Background(), items)
+			if err != nil {
+				t.Error(err)
+			}
+			sem <- 1
+		}(i)
+	}
+
+	for i := 0; i < 20; i++ {
+		<-sem
+	}
+
+	for _, key := range keys {
+		bucket, _ := storage.Get(context.Background(), key)
+		if bucket.Used.Ceil() != 15 {
+			t.Error("Used should be 15", key, bucket)
+		}
+	}
+}
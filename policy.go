@@ -0,0 +1,179 @@
+package ratelimit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNoPolicy    = errors.New("No policy for key")
+	ErrClientLimit = errors.New("Limit, duration, algorithm and burst are set by the server")
+)
+
+// Ways a Policy can match keys.
+const (
+	MatchPrefix = "prefix"
+	MatchGlob   = "glob"
+	MatchRegex  = "regex"
+)
+
+// Algorithms a Policy can limit its keys with.
+const (
+	AlgorithmTokenBucket   = "tokenbucket"
+	AlgorithmGCRA          = "gcra"
+	AlgorithmSlidingLog    = "slidinglog"
+	AlgorithmSlidingWindow = "slidingwindow"
+	AlgorithmFixedWindow   = "fixedwindow"
+	AlgorithmLeakyBucket   = "leakybucket"
+)
+
+// A Policy sets the limit and duration of the keys matching Pattern, so
+// that clients do not have to send them. Match is one of MatchPrefix,
+// MatchGlob, where * and ? match any characters, or MatchRegex. Burst is
+// only allowed with AlgorithmTokenBucket, see Options.
+type Policy struct {
+	Match     string
+	Pattern   string
+	Limit     int64
+	Duration  time.Duration
+	Algorithm string
+	Burst     int64
+}
+
+// PolicyRegistry finds the policy of a key. A key gets the first policy
+// that matches it, in the order the policies were given.
+type PolicyRegistry struct {
+	policies []Policy
+	matchers []*regexp.Regexp
+}
+
+func NewPolicyRegistry(policies []Policy) (*PolicyRegistry, error) {
+	r := &PolicyRegistry{
+		policies: make([]Policy, len(policies)),
+		matchers: make([]*regexp.Regexp, len(policies)),
+	}
+	for i, policy := range policies {
+		if policy.Algorithm == "" {
+			policy.Algorithm = AlgorithmTokenBucket
+		}
+		err := checkPolicy(policy)
+		if err != nil {
+			return nil, fmt.Errorf("policy %d: %s", i+1, err)
+		}
+		matcher, err := compilePattern(policy.Match, policy.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("policy %d: %s", i+1, err)
+		}
+		r.policies[i] = policy
+		r.matchers[i] = matcher
+	}
+	return r, nil
+}
+
+// Lookup returns the policy of key.
+func (r *PolicyRegistry) Lookup(key string) (Policy, bool) {
+	for i, matcher := range r.matchers {
+		if matcher.MatchString(key) {
+			return r.policies[i], true
+		}
+	}
+	return Policy{}, false
+}
+
+// Policies returns the policies of r in lookup order.
+func (r *PolicyRegistry) Policies() []Policy {
+	return append([]Policy(nil), r.policies...)
+}
+
+func checkPolicy(policy Policy) error {
+	switch true {
+	case policy.Pattern == "":
+		return errors.New("Pattern cannot be empty")
+	case policy.Limit <= 0:
+		return ErrLimitZero
+	case policy.Duration <= 0:
+		return ErrZeroDuration
+	case !IsAlgorithm(policy.Algorithm):
+		return fmt.Errorf("Unknown algorithm '%s'", policy.Algorithm)
+	case policy.Burst < 0:
+		return ErrBurstNegative
+	case policy.Burst > 0 && policy.Algorithm != AlgorithmTokenBucket:
+		return ErrBurstAlgorithm
+	}
+	return nil
+}
+
+// compilePattern turns every kind of pattern into a regular expression.
+func compilePattern(match, pattern string) (*regexp.Regexp, error) {
+	switch match {
+	case MatchPrefix:
+		return regexp.Compile("^" + regexp.QuoteMeta(pattern))
+	case MatchGlob:
+		quoted := regexp.QuoteMeta(pattern)
+		quoted = strings.Replace(quoted, `\*`, ".*", -1)
+		quoted = strings.Replace(quoted, `\?`, ".", -1)
+		return regexp.Compile("^" + quoted + "$")
+	case MatchRegex:
+		return regexp.Compile(pattern)
+	}
+	return nil, fmt.Errorf("Unknown match '%s'", match)
+}
+
+// String describes policy for logs, such as "prefix user: 10/1m0s tokenbucket"
+// or "prefix user: 10/1s tokenbucket burst 50".
+func (policy Policy) String() string {
+	s := fmt.Sprintf("%s %s %d/%s %s", policy.Match, policy.Pattern, policy.Limit, policy.Duration, policy.Algorithm)
+	if policy.Burst > 0 {
+		s += fmt.Sprintf(" burst %d", policy.Burst)
+	}
+	return s
+}
+
+// jsonPolicy is how a Policy is written in a policy file. Durations use
+// the same format as the duration field of requests.
+type jsonPolicy struct {
+	Match     string `json:"match"`
+	Pattern   string `json:"pattern"`
+	Limit     int64  `json:"limit"`
+	Duration  string `json:"duration"`
+	Algorithm string `json:"algorithm,omitempty"`
+	Burst     int64  `json:"burst,omitempty"`
+}
+
+func (policy Policy) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonPolicy{policy.Match, policy.Pattern, policy.Limit, policy.Duration.String(), policy.Algorithm, policy.Burst})
+}
+
+func (policy *Policy) UnmarshalJSON(data []byte) error {
+	var p jsonPolicy
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&p)
+	if err != nil {
+		return err
+	}
+	duration, err := time.ParseDuration(p.Duration)
+	if err != nil {
+		return fmt.Errorf("'%s' is not a valid duration value", p.Duration)
+	}
+	*policy = Policy{p.Match, p.Pattern, p.Limit, duration, p.Algorithm, p.Burst}
+	return nil
+}
+
+// ReadPolicies reads a JSON list of policies such as
+//
+//	[{"match": "prefix", "pattern": "user:", "limit": 10, "duration": "1m"}]
+func ReadPolicies(r io.Reader) ([]Policy, error) {
+	var policies []Policy
+	err := json.NewDecoder(r).Decode(&policies)
+	if err != nil {
+		return nil, err
+	}
+	return policies, nil
+}
@@ -0,0 +1,71 @@
+package ratelimit
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPolicyRegistryLookup(t *testing.T) {
+	registry, err := NewPolicyRegistry([]Policy{
+		{MatchPrefix, "user:admin", 1000, time.Minute, "", 0},
+		{MatchGlob, "user:*:upload", 5, time.Hour, "", 0},
+		{MatchPrefix, "user:", 10, time.Minute, "", 0},
+		{MatchRegex, `^org:[0-9]+$`, 100, time.Second, AlgorithmTokenBucket, 0},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		key   string
+		limit int64
+	}{
+		{"user:admin", 1000},
+		{"user:42/avatar:upload", 5},
+		{"user:42", 10},
+		{"org:7", 100},
+		{"org:x", 0},
+	}
+	for _, test := range tests {
+		policy, ok := registry.Lookup(test.key)
+		if ok != (test.limit != 0) || policy.Limit != test.limit {
+			t.Error("Wrong policy for", test.key, policy)
+		}
+	}
+	if policy, _ := registry.Lookup("user:42"); policy.Algorithm != AlgorithmTokenBucket {
+		t.Error("Algorithm should default to token bucket", policy.Algorithm)
+	}
+}
+
+func TestPolicyRegistryInvalid(t *testing.T) {
+	policies := [][]Policy{
+		{{"suffix", "user:", 10, time.Minute, "", 0}},
+		{{MatchRegex, "user:(", 10, time.Minute, "", 0}},
+		{{MatchPrefix, "user:", 0, time.Minute, "", 0}},
+		{{MatchPrefix, "user:", 10, 0, "", 0}},
+		{{MatchPrefix, "user:", 10, time.Minute, "magic", 0}},
+		{{MatchPrefix, "user:", 10, time.Minute, "", -1}},
+		{{MatchPrefix, "user:", 10, time.Minute, AlgorithmGCRA, 20}},
+	}
+	for _, p := range policies {
+		if _, err := NewPolicyRegistry(p); err == nil {
+			t.Error("Policy should be rejected", p)
+		}
+	}
+}
+
+func TestReadPolicies(t *testing.T) {
+	policies, err := ReadPolicies(strings.NewReader(`[
+		{"match": "prefix", "pattern": "user:", "limit": 10, "duration": "1m"}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policies) != 1 || policies[0] != (Policy{MatchPrefix, "user:", 10, time.Minute, "", 0}) {
+		t.Error("Policies are wrong", policies)
+	}
+	_, err = ReadPolicies(strings.NewReader(`[{"match": "prefix", "pattern": "user:", "limit": 10, "duration": "soon"}]`))
+	if err == nil {
+		t.Error("Invalid duration should be rejected")
+	}
+}
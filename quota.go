@@ -0,0 +1,166 @@
+package ratelimit
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	ErrUnknownPeriod = errors.New("Unknown period")
+)
+
+// Calendar periods of a Quota.
+const (
+	PeriodHour  = "hour"
+	PeriodDay   = "day"
+	PeriodWeek  = "week"
+	PeriodMonth = "month"
+)
+
+// A Quota allows Limit tokens per calendar Period in Location, such as
+// 10000 per month starting on the first at midnight in New York. Weeks
+// start on Monday. A nil Location is the location of the limiter.
+type Quota struct {
+	Limit    int64
+	Period   string
+	Location *time.Location
+}
+
+// IsPeriod reports whether name is one of the Period constants.
+func IsPeriod(name string) bool {
+	switch name {
+	case PeriodHour, PeriodDay, PeriodWeek, PeriodMonth:
+		return true
+	}
+	return false
+}
+
+// periodBounds returns the start and the end of the period of now in
+// location. Periods follow the wall clock, so a day lasts 23 or 25 hours
+// when daylight saving time starts or ends.
+func periodBounds(now time.Time, period string, location *time.Location) (time.Time, time.Time) {
+	if location == nil {
+		location = time.UTC
+	}
+	local := now.In(location)
+	year, month, day := local.Date()
+	switch period {
+	case PeriodHour:
+		start := local.Truncate(time.Hour)
+		if _, offset := local.Zone(); offset%3600 != 0 {
+			// Zones such as India's are not a whole number of hours
+			// away from UTC
+			start = time.Date(year, month, day, local.Hour(), 0, 0, 0, location)
+		}
+		return start, start.Add(time.Hour)
+	case PeriodDay:
+		start := time.Date(year, month, day, 0, 0, 0, 0, location)
+		return start, time.Date(year, month, day+1, 0, 0, 0, 0, location)
+	case PeriodWeek:
+		// Weekdays count from Sunday
+		day -= (int(local.Weekday()) + 6) % 7
+		start := time.Date(year, month, day, 0, 0, 0, 0, location)
+		return start, time.Date(year, month, day+7, 0, 0, 0, 0, location)
+	}
+	start := time.Date(year, month, 1, 0, 0, 0, 0, location)
+	return start, time.Date(year, month+1, 1, 0, 0, 0, 0, location)
+}
+
+// quotaPeriod is the state of a key under a quota: the count of the
+// current period.
+type quotaPeriod struct {
+	limit int64
+	start time.Time
+	end   time.Time
+	count int64
+}
+
+// result describes p at now for a caller that wants count tokens. Reset is
+// the start of the next period.
+func (p *quotaPeriod) result(count int64, now time.Time) Result {
+	remaining := p.limit - p.count
+	if remaining < 0 {
+		remaining = 0
+	}
+	var retryAfter time.Duration
+	if p.count+count > p.limit {
+		retryAfter = p.end.Sub(now)
+	}
+	return Result{
+		Used:       p.count,
+		Remaining:  remaining,
+		Limit:      p.limit,
+		Window:     p.end.Sub(p.start),
+		Reset:      p.end,
+		RetryAfter: retryAfter,
+	}
+}
+
+// handleQuota runs the GET and POST requests of a quota. Quotas keep their
+// counts with the counters of the window algorithms, one per period, under
+// a key of their own for every period.
+func handleQuota(storage Storage, settings settings, now time.Time, req request) response {
+	s, err := counterStorage(storage)
+	if err != nil {
+		return response{err: err}
+	}
+	location := req.location
+	if location == nil {
+		location = settings.location
+	}
+	key := stateKey("quota", req.period+":"+req.key)
+	start, end := periodBounds(now, req.period, location)
+	counters, err := s.GetCounters(req.ctx, key, []time.Time{start})
+	if err != nil {
+		return response{err: err}
+	}
+	p := &quotaPeriod{limit: req.limit, start: start, end: end}
+	if counters != nil {
+		p.count = counters.Counts[0]
+	}
+	switch req.method {
+	case GET:
+		if counters == nil {
+			return response{err: ErrNotFound}
+		}
+		return response{result: p.result(req.count, now)}
+	case POST:
+		if p.count+req.count > p.limit {
+			return response{result: p.result(req.count, now), err: ErrLimitReached}
+		}
+		// The count is of no use once its period is over
+		count, err := s.IncrCounter(req.ctx, key, start, req.count, p.limit, end.Sub(start), end.Sub(now))
+		if err != nil {
+			return response{err: err}
+		}
+		if count > p.limit {
+			// Other posts took the tokens since the count was read, so the
+			// increment is taken back
+			p.count, err = s.IncrCounter(req.ctx, key, start, -req.count, p.limit, end.Sub(start), end.Sub(now))
+			if err != nil {
+				return response{err: err}
+			}
+			return response{result: p.result(req.count, now), err: ErrLimitReached}
+		}
+		p.count = count
+		return response{result: p.result(0, now)}
+	}
+	return response{err: errors.New("Undefined Method")}
+}
+
+func checkQuotaArgs(key string, count int64, quota Quota) error {
+	switch true {
+	case len(strings.TrimSpace(key)) == 0:
+		return ErrKeyEmpty
+	case count <= 0:
+		return ErrCountZero
+	case quota.Limit <= 0:
+		return ErrLimitZero
+	case count > quota.Limit:
+		return ErrCountLimit
+	case !IsPeriod(quota.Period):
+		return ErrUnknownPeriod
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package ratelimit
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPeriodBounds(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("No time zone database", err)
+	}
+	india := time.FixedZone("IST", 5*60*60+30*60)
+	tests := []struct {
+		now        time.Time
+		period     string
+		location   *time.Location
+		start, end time.Time
+	}{
+		{time.Date(2017, 7, 14, 2, 40, 0, 0, time.UTC), PeriodHour, nil,
+			time.Date(2017, 7, 14, 2, 0, 0, 0, time.UTC), time.Date(2017, 7, 14, 3, 0, 0, 0, time.UTC)},
+		{time.Date(2017, 7, 14, 2, 40, 0, 0, india), PeriodHour, india,
+			time.Date(2017, 7, 14, 2, 0, 0, 0, india), time.Date(2017, 7, 14, 3, 0, 0, 0, india)},
+		{time.Date(2017, 7, 14, 2, 40, 0, 0, time.UTC), PeriodDay, newYork,
+			time.Date(2017, 7, 13, 0, 0, 0, 0, newYork), time.Date(2017, 7, 14, 0, 0, 0, 0, newYork)},
+		// A Friday, in a week starting on Monday
+		{time.Date(2017, 7, 14, 12, 0, 0, 0, time.UTC), PeriodWeek, nil,
+			time.Date(2017, 7, 10, 0, 0, 0, 0, time.UTC), time.Date(2017, 7, 17, 0, 0, 0, 0, time.UTC)},
+		// A Sunday ends the week
+		{time.Date(2017, 7, 16, 12, 0, 0, 0, time.UTC), PeriodWeek, nil,
+			time.Date(2017, 7, 10, 0, 0, 0, 0, time.UTC), time.Date(2017, 7, 17, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2017, 12, 31, 23, 0, 0, 0, newYork), PeriodMonth, newYork,
+			time.Date(2017, 12, 1, 0, 0, 0, 0, newYork), time.Date(2018, 1, 1, 0, 0, 0, 0, newYork)},
+		// Still January in UTC
+		{time.Date(2018, 2, 1, 3, 0, 0, 0, time.UTC), PeriodMonth, newYork,
+			time.Date(2018, 1, 1, 0, 0, 0, 0, newYork), time.Date(2018, 2, 1, 0, 0, 0, 0, newYork)},
+	}
+	for _, test := range tests {
+		start, end := periodBounds(test.now, test.period, test.location)
+		if !start.Equal(test.start) || !end.Equal(test.end) {
+			t.Error("Wrong bounds for", test.now, test.period, start, end)
+		}
+	}
+	// Daylight saving time starts on March 12th
+	start, end := periodBounds(time.Date(2017, 3, 12, 12, 0, 0, 0, newYork), PeriodDay, newYork)
+	if end.Sub(start) != time.Hour*23 {
+		t.Error("The day should last 23 hours", start, end)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	storage := NewDummyStorage()
+	clock := NewFakeClock(time.Date(2017, 7, 31, 22, 0, 0, 0, time.UTC))
+	limiter := NewSingleThreadLimiter(storage)
+	limiter.SetClock(clock)
+	limiter.Start()
+	defer limiter.Stop()
+	ctx := context.Background()
+	location := time.FixedZone("UTC-5", -5*60*60)
+	quota := Quota{10, PeriodMonth, location}
+	if _, err := limiter.GetQuota(ctx, "testkey1", quota); err != ErrNotFound {
+		t.Error("Quota should not be found", err)
+	}
+	result, err := limiter.PostQuota(ctx, "testkey1", 10, quota)
+	if err != nil || result.Used != 10 {
+		t.Error("Used should be 10", result, err)
+	}
+	if reset := time.Date(2017, 8, 1, 0, 0, 0, 0, location); !result.Reset.Equal(reset) || result.Window != time.Hour*24*31 {
+		t.Error("Reset should be the first of the next month", result)
+	}
+	result, err = limiter.PostQuota(ctx, "testkey1", 1, quota)
+	if err != ErrLimitReached || result.RetryAfter != time.Hour*7 {
+		t.Error("Limit should be reached until the next month", result, err)
+	}
+	if result, _ = limiter.PostQuota(ctx, "testkey1", 1, Quota{10, PeriodDay, location}); result.Used != 1 {
+		t.Error("Every period should have its own count", result)
+	}
+	clock.Advance(time.Hour * 7)
+	result, err = limiter.PostQuota(ctx, "testkey1", 1, quota)
+	if err != nil || result.Used != 1 {
+		t.Error("A new month should start from zero", result, err)
+	}
+	result, err = limiter.GetQuota(ctx, "testkey1", quota)
+	if err != nil || result.Used != 1 || result.Remaining != 9 {
+		t.Error("Get should report the usage", result, err)
+	}
+
+	if _, err := limiter.PostQuota(ctx, "testkey1", 1, Quota{10, "year", nil}); err != ErrUnknownPeriod {
+		t.Error("Unknown periods should be rejected", err)
+	}
+}
+
+func TestQuotaConcurrentIncrement(t *testing.T) {
+	storage := &racingCounterStorage{DummyStorage: NewDummyStorage(), count: 3, raced: true}
+	clock := NewFakeClock(time.Date(2017, 7, 14, 2, 0, 0, 0, time.UTC))
+	limiter := NewShardedLimiter(storage, 1)
+	limiter.SetClock(clock)
+	ctx := context.Background()
+	quota := Quota{5, PeriodDay, nil}
+	limiter.PostQuota(ctx, "testkey1", 1, quota)
+	storage.raced = false
+	result, err := limiter.PostQuota(ctx, "testkey1", 2, quota)
+	if err != ErrLimitReached || result.Used != 4 {
+		t.Error("An increment over the limit should be taken back", result, err)
+	}
+	result, err = limiter.PostQuota(ctx, "testkey1", 1, quota)
+	if err != nil || result.Used != 5 {
+		t.Error("Post should pass on top of the other instance", result, err)
+	}
+}
+
+// Memcache takes expirations over 30 days as Unix timestamps, which monthly
+// quotas need.
+func TestExpireSeconds(t *testing.T) {
+	if seconds := expireSeconds(time.Millisecond * 1500); seconds != 2 {
+		t.Error("Expirations should be rounded up", seconds)
+	}
+	if seconds := expireSeconds(maxRelativeExpiration); seconds != 30*24*60*60 {
+		t.Error("30 days should be relative", seconds)
+	}
+	month := time.Hour * 24 * 31
+	expected := time.Now().Add(month).Unix()
+	if seconds := int64(expireSeconds(month)); seconds < expected || seconds > expected+1 {
+		t.Error("Longer expirations should be absolute", seconds, expected)
+	}
+}
+
+func TestHttpServerQuota(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	httpServer := NewHttpServer(NewShardedLimiter(NewDummyStorage(), 1), logger)
+	serve := func(method, query string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest(method, "/quota?"+query, nil)
+		httpServer.ServeHTTP(recorder, request)
+		return recorder
+	}
+	if recorder := serve("GET", "key=testkey1&limit=2&period=day"); recorder.Code != http.StatusNotFound {
+		t.Error("Quota should not be found", recorder.Code)
+	}
+	if recorder := serve("POST", "key=testkey1&count=2&limit=2&period=day&timezone=UTC"); recorder.Code != http.StatusOK {
+		t.Error("Status code is not 200", recorder.Code, recorder.Body.String())
+	}
+	if recorder := serve("POST", "key=testkey1&count=1&limit=2&period=day"); recorder.Code != http.StatusMethodNotAllowed {
+		t.Error("Limit should be reached", recorder.Code)
+	}
+	if recorder := serve("GET", "key=testkey1&limit=2&period=day"); recorder.Code != http.StatusOK || recorder.Body.String() != "2\n" {
+		t.Error("Get should report the usage", recorder.Code, recorder.Body.String())
+	}
+	if recorder := serve("POST", "key=testkey1&count=1&limit=2&period=day&timezone=Mars/Olympus_Mons"); recorder.Code != http.StatusBadRequest {
+		t.Error("Unknown timezones should be rejected", recorder.Code)
+	}
+	if recorder := serve("POST", "key=testkey1&count=1&limit=2&period=fortnight"); recorder.Code != http.StatusBadRequest {
+		t.Error("Unknown periods should be rejected", recorder.Code)
+	}
+}
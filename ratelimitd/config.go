@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+import (
+	"github.com/ctulek/ratelimit"
+)
+
+// config is everything ratelimitd can be configured with. It starts out
+// from the command line flags, and a config file overrides the fields it
+// sets.
+type config struct {
+	Port            int                `json:"port"`
+	Storage         storageConfig      `json:"storage"`
+	Shards          int                `json:"shards"`
+	Timeout         duration           `json:"timeout"`
+	ShutdownTimeout duration           `json:"shutdownTimeout"`
+	ReservationTTL  duration           `json:"reservationTTL"`
+	ReloadInterval  duration           `json:"reloadInterval"`
+	Migration       string             `json:"migration"`
+	Timezone        string             `json:"timezone"`
+	StrictPolicies  bool               `json:"strictPolicies"`
+	Default         *defaultLimit      `json:"default"`
+	Policies        []ratelimit.Policy `json:"policies"`
+}
+
+type storageConfig struct {
+	Type     string `json:"type"`
+	Host     string `json:"host"`
+	Prefix   string `json:"prefix"`
+	PoolSize int    `json:"poolSize"`
+}
+
+// defaultLimit applies to the keys that no policy matches.
+type defaultLimit struct {
+	Limit     int64    `json:"limit"`
+	Duration  duration `json:"duration"`
+	Algorithm string   `json:"algorithm"`
+	Burst     int64    `json:"burst"`
+}
+
+// duration is a time.Duration written like the duration of requests.
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("'%s' is not a valid duration value", s)
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+// flagConfig returns the configuration given on the command line.
+func flagConfig() (*config, error) {
+	c := &config{
+		Port:            *port,
+		Shards:          *shards,
+		Timeout:         duration(*timeout),
+		ShutdownTimeout: duration(*shutdownTimeout),
+		ReservationTTL:  duration(*reservationTTL),
+		ReloadInterval:  duration(*reloadInterval),
+		Migration:       *migration,
+		Timezone:        *timezone,
+		StrictPolicies:  *strictPolicies,
+	}
+	c.Storage.Prefix = *redisPrefix
+	c.Storage.PoolSize = *redisConnPoolSize
+	if *memcacheHost != "" {
+		c.Storage.Type, c.Storage.Host = "memcache", *memcacheHost
+	} else if *redisHost != "" {
+		c.Storage.Type, c.Storage.Host = "redis", *redisHost
+	} else {
+		c.Storage.Type = "dummy"
+	}
+	if *policies != "" {
+		f, err := os.Open(*policies)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		c.Policies, err = ratelimit.ReadPolicies(f)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", *policies, err)
+		}
+	}
+	return c, nil
+}
+
+// loadConfig reads the config file at path on top of the flags and
+// validates the result.
+func loadConfig(path string) (*config, *ratelimit.PolicyRegistry, error) {
+	c, err := flagConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer f.Close()
+		// A misspelled field would otherwise be taken for one left out
+		decoder := json.NewDecoder(f)
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(c)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %s", path, err)
+		}
+	}
+	registry, err := c.validate()
+	if err != nil {
+		return nil, nil, err
+	}
+	return c, registry, nil
+}
+
+// validate checks c and builds its policy registry.
+func (c *config) validate() (*ratelimit.PolicyRegistry, error) {
+	switch c.Storage.Type {
+	case "dummy":
+	case "memcache", "redis":
+		if c.Storage.Host == "" {
+			return nil, fmt.Errorf("%s storage needs a host", c.Storage.Type)
+		}
+	default:
+		return nil, fmt.Errorf("Unknown storage type '%s'", c.Storage.Type)
+	}
+	if c.Port <= 0 || c.Port > 65535 {
+		return nil, fmt.Errorf("Invalid port %d", c.Port)
+	}
+	if c.Shards < 1 {
+		return nil, errors.New("There should be at least 1 shard")
+	}
+	if c.ReloadInterval < 0 || c.Timeout < 0 || c.ShutdownTimeout < 0 || c.ReservationTTL <= 0 {
+		return nil, errors.New("Durations cannot be negative and reservationTTL cannot be zero")
+	}
+	if _, ok := migrations[c.Migration]; !ok {
+		return nil, fmt.Errorf("Unknown migration '%s'", c.Migration)
+	}
+	if _, err := time.LoadLocation(c.Timezone); err != nil {
+		return nil, fmt.Errorf("Unknown timezone '%s'", c.Timezone)
+	}
+	if c.StrictPolicies && len(c.policies()) == 0 {
+		return nil, errors.New("strictPolicies needs policies")
+	}
+	return ratelimit.NewPolicyRegistry(c.policies())
+}
+
+var migrations = map[string]ratelimit.Migration{
+	"carryover": ratelimit.CarryOver,
+	"rescale":   ratelimit.Rescale,
+}
+
+func (c *config) migration() ratelimit.Migration {
+	return migrations[c.Migration]
+}
+
+// location returns the location fixed windows are aligned to, nil for the
+// Unix epoch.
+func (c *config) location() *time.Location {
+	if c.Timezone == "" {
+		return nil
+	}
+	location, _ := time.LoadLocation(c.Timezone)
+	return location
+}
+
+// policies returns the policies of c, followed by a catch-all policy for
+// the default limit if there is one.
+func (c *config) policies() []ratelimit.Policy {
+	if c.Default == nil {
+		return c.Policies
+	}
+	catchAll := ratelimit.Policy{
+		Match:     ratelimit.MatchGlob,
+		Pattern:   "*",
+		Limit:     c.Default.Limit,
+		Duration:  time.Duration(c.Default.Duration),
+		Algorithm: c.Default.Algorithm,
+		Burst:     c.Default.Burst,
+	}
+	return append(append([]ratelimit.Policy(nil), c.Policies...), catchAll)
+}
+
+// restartNeeded lists the settings that differ between c and next but
+// cannot change while the server is running.
+func (c *config) restartNeeded(next *config) []string {
+	var fields []string
+	if c.Port != next.Port {
+		fields = append(fields, "port")
+	}
+	if c.Storage != next.Storage {
+		fields = append(fields, "storage")
+	}
+	if c.Shards != next.Shards {
+		fields = append(fields, "shards")
+	}
+	if c.ShutdownTimeout != next.ShutdownTimeout {
+		fields = append(fields, "shutdownTimeout")
+	}
+	if c.ReloadInterval != next.ReloadInterval {
+		fields = append(fields, "reloadInterval")
+	}
+	if c.Migration != next.Migration {
+		fields = append(fields, "migration")
+	}
+	if c.Timezone != next.Timezone {
+		fields = append(fields, "timezone")
+	}
+	return fields
+}
+
+// diffPolicies describes how the policies changed from old to new, one
+// line per added (+), removed (-) or changed (~) pattern.
+func diffPolicies(old, new []ratelimit.Policy) []string {
+	type pattern struct{ match, pattern string }
+	before := make(map[pattern]ratelimit.Policy, len(old))
+	for _, policy := range old {
+		before[pattern{policy.Match, policy.Pattern}] = policy
+	}
+	var lines []string
+	after := make(map[pattern]bool, len(new))
+	for _, policy := range new {
+		p := pattern{policy.Match, policy.Pattern}
+		after[p] = true
+		previous, ok := before[p]
+		if !ok {
+			lines = append(lines, "+ "+policy.String())
+		} else if previous != policy {
+			lines = append(lines, "~ "+previous.String()+" => "+policy.String())
+		}
+	}
+	for _, policy := range old {
+		if !after[pattern{policy.Match, policy.Pattern}] {
+			lines = append(lines, "- "+policy.String())
+		}
+	}
+	return lines
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/ctulek/ratelimit"
+)
+
+func writeConfig(t *testing.T, data string) string {
+	dir, err := ioutil.TempDir("", "ratelimitd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "config.json")
+	err = ioutil.WriteFile(path, []byte(data), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeConfig(t, `{
+		"storage": {"type": "redis", "host": "localhost:6379"},
+		"timeout": "500ms",
+		"default": {"limit": 100, "duration": "1m"},
+		"policies": [{"match": "prefix", "pattern": "user:", "limit": 10, "duration": "1s"}]
+	}`)
+	cfg, registry, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Port != *port || cfg.Storage.Prefix != *redisPrefix {
+		t.Error("Fields left out should keep the flag values", cfg)
+	}
+	if cfg.Storage.Type != "redis" || time.Duration(cfg.Timeout) != time.Millisecond*500 {
+		t.Error("Fields of the file should override the flags", cfg)
+	}
+	if policy, _ := registry.Lookup("user:1"); policy.Limit != 10 {
+		t.Error("Wrong policy for user:1", policy)
+	}
+	if policy, _ := registry.Lookup("org:1"); policy.Limit != 100 {
+		t.Error("Default limit should apply to other keys", policy)
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	configs := []string{
+		`{"storage": {"type": "mysql"}}`,
+		`{"storage": {"type": "redis"}}`,
+		`{"shards": 0}`,
+		`{"timeout": "soon"}`,
+		`{"strictPolicies": true}`,
+		`{"policies": [{"match": "prefix", "pattern": "user:", "limit": 0, "duration": "1s"}]}`,
+		`{"port": "9090"}`,
+		`{"migration": "reset"}`,
+		`{"timezone": "Mars/Olympus_Mons"}`,
+		`{"polices": [{"match": "prefix", "pattern": "user:", "limit": 10, "duration": "1s"}]}`,
+		`{"policies": [{"match": "prefix", "pattern": "user:", "limit": 10, "duration": "1s", "algoritm": "gcra"}]}`,
+	}
+	for _, data := range configs {
+		if _, _, err := loadConfig(writeConfig(t, data)); err == nil {
+			t.Error("Config should be rejected", data)
+		}
+	}
+}
+
+func TestDiffPolicies(t *testing.T) {
+	old := []ratelimit.Policy{
+		{Match: ratelimit.MatchPrefix, Pattern: "user:", Limit: 10, Duration: time.Second, Algorithm: "tokenbucket"},
+		{Match: ratelimit.MatchPrefix, Pattern: "org:", Limit: 100, Duration: time.Second, Algorithm: "tokenbucket"},
+	}
+	new := []ratelimit.Policy{
+		{Match: ratelimit.MatchPrefix, Pattern: "user:", Limit: 20, Duration: time.Second, Algorithm: "tokenbucket"},
+		{Match: ratelimit.MatchGlob, Pattern: "*", Limit: 5, Duration: time.Minute, Algorithm: "tokenbucket"},
+	}
+	lines := diffPolicies(old, new)
+	expected := []string{
+		"~ prefix user: 10/1s tokenbucket => prefix user: 20/1s tokenbucket",
+		"+ glob * 5/1m0s tokenbucket",
+		"- prefix org: 100/1s tokenbucket",
+	}
+	if len(lines) != len(expected) {
+		t.Fatal("Diff is wrong", lines)
+	}
+	for i := range lines {
+		if lines[i] != expected[i] {
+			t.Error("Diff is wrong", lines[i])
+		}
+	}
+}
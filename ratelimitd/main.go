@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
@@ -9,6 +10,8 @@ import (
 	"os/signal"
 	"runtime"
 	"runtime/pprof"
+	"syscall"
+	"time"
 )
 
 import (
@@ -22,6 +25,16 @@ var (
 	memcacheHost      = flag.String("memcache", "", "Memcache host and port. Eg: localhost:11211")
 	redisPrefix       = flag.String("redisPrefix", "rl_", "Redis prefix to attach to keys")
 	cpuprofile        = flag.String("cpuprofile", "", "write cpu profile to file")
+	timeout           = flag.Duration("timeout", 0, "Maximum time to serve a single request. Eg: 500ms. Default: no timeout")
+	shutdownTimeout   = flag.Duration("shutdownTimeout", 10*time.Second, "Maximum time to wait for in-flight requests on shutdown")
+	reservationTTL    = flag.Duration("reservationTTL", ratelimit.DefaultReservationTTL, "Time after which uncommitted reservations expire")
+	shards            = flag.Int("shards", 1, "Number of limiter shards. 1 serializes all keys on a single goroutine")
+	policies          = flag.String("policies", "", "JSON file of policies that set the limit and duration of keys")
+	strictPolicies    = flag.Bool("strictPolicies", false, "Reject requests that send their own limit or duration, or whose key has no policy")
+	migration         = flag.String("migration", "carryover", "What happens to the usage of a key when its limit or duration changes: carryover or rescale")
+	timezone          = flag.String("timezone", "", "Timezone whose wall clock fixed windows are aligned to. Eg: America/New_York. Default: the Unix epoch (UTC)")
+	configPath        = flag.String("config", "", "JSON config file. Its fields override the flags. Reloaded on SIGHUP or when it changes")
+	reloadInterval    = flag.Duration("reloadInterval", 5*time.Second, "How often to check the config file for changes. 0 reloads only on SIGHUP")
 )
 
 func usage() {
@@ -30,6 +43,11 @@ func usage() {
 	flag.PrintDefaults()
 }
 
+// reservationTTLSetter is implemented by both kinds of limiter.
+type reservationTTLSetter interface {
+	SetReservationTTL(ttl time.Duration)
+}
+
 func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
@@ -45,44 +63,139 @@ func main() {
 		fmt.Println("Profiling to file", f.Name())
 	}
 
-	fmt.Printf("Starting the HTTP server at port %d...\n", *port)
+	cfg, registry, err := loadConfig(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("Starting the HTTP server at port %d...\n", cfg.Port)
 
 	// Set the storage
 	var storage ratelimit.Storage
-	if *memcacheHost != "" {
-		client := ratelimit.NewMemcacheClient(*memcacheHost)
-		storage = ratelimit.NewMemcacheStorage(client, *redisPrefix)
+	switch cfg.Storage.Type {
+	case "memcache":
+		client := ratelimit.NewMemcacheClient(cfg.Storage.Host)
+		storage = ratelimit.NewMemcacheStorage(client, cfg.Storage.Prefix)
 		fmt.Println("Using Memcache for backend storage")
-	} else if *redisHost != "" {
-		redisConnPool := ratelimit.NewRedisConnectionPool(*redisHost, *redisConnPoolSize)
-		storage = ratelimit.NewRedisStorage(redisConnPool, *redisPrefix)
+	case "redis":
+		redisConnPool := ratelimit.NewRedisConnectionPool(cfg.Storage.Host, cfg.Storage.PoolSize)
+		storage = ratelimit.NewRedisStorage(redisConnPool, cfg.Storage.Prefix)
 		fmt.Println("Using Redis for backend storage")
-	} else {
+	default:
 		storage = ratelimit.NewDummyStorage()
 		fmt.Println("WARNING: Using Dummy Storage for backend storage")
 	}
 
 	// Set the limiter
-	limiter := ratelimit.NewSingleThreadLimiter(storage)
-	limiter.Start()
-	defer limiter.Stop()
+	clock := ratelimit.SystemClock
+	var limiter ratelimit.Limiter
+	if cfg.Shards > 1 {
+		shardedLimiter := ratelimit.NewShardedLimiter(storage, cfg.Shards)
+		shardedLimiter.SetClock(clock)
+		shardedLimiter.SetMigration(cfg.migration())
+		shardedLimiter.SetLocation(cfg.location())
+		limiter = shardedLimiter
+		fmt.Printf("Using sharded limiter with %d shards\n", cfg.Shards)
+	} else {
+		singleThreadLimiter := ratelimit.NewSingleThreadLimiter(storage)
+		singleThreadLimiter.SetClock(clock)
+		singleThreadLimiter.SetMigration(cfg.migration())
+		singleThreadLimiter.SetLocation(cfg.location())
+		singleThreadLimiter.Start()
+		limiter = singleThreadLimiter
+	}
+	limiter.(reservationTTLSetter).SetReservationTTL(time.Duration(cfg.ReservationTTL))
 	logger := log.New(os.Stdout, "", log.LstdFlags)
 
 	// Set HTTP Server
 	httpServer := ratelimit.NewHttpServer(limiter, logger)
+	httpServer.SetTimeout(time.Duration(cfg.Timeout))
+	httpServer.SetPolicies(registry, cfg.StrictPolicies)
+	if policies := registry.Policies(); len(policies) > 0 {
+		fmt.Printf("Loaded %d policies\n", len(policies))
+	}
 	http.Handle("/", httpServer)
+	server := &http.Server{Addr: fmt.Sprintf(":%d", cfg.Port)}
+
+	if *configPath != "" {
+		go watchConfig(*configPath, cfg, registry, httpServer, limiter)
+	}
 
+	// On a signal stop accepting connections, let the in-flight requests
+	// finish and then drain the limiter before exiting
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, os.Kill)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	idle := make(chan int)
 	go func() {
 		s := <-c
 		fmt.Println("Got signal:", s)
-		if *cpuprofile != "" {
-			pprof.StopCPUProfile()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout))
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			fmt.Println("HTTP server shutdown:", err)
+		}
+		if err := limiter.Shutdown(ctx); err != nil {
+			fmt.Println("Limiter shutdown:", err)
 		}
-		os.Exit(0)
+		close(idle)
 	}()
 
 	fmt.Println("Server started and ready to serve")
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *port), nil))
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-idle
+	fmt.Println("Server stopped")
+}
+
+// watchConfig reloads the config file on SIGHUP and whenever its
+// modification time changes. A config that does not validate is logged
+// and ignored. Only the settings that can change while serving are
+// applied; requests in flight finish with the settings they started with.
+func watchConfig(path string, cfg *config, registry *ratelimit.PolicyRegistry, httpServer *ratelimit.HttpServer, limiter ratelimit.Limiter) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	var tick <-chan time.Time
+	if cfg.ReloadInterval > 0 {
+		ticker := time.NewTicker(time.Duration(cfg.ReloadInterval))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	modTime := fileModTime(path)
+	for {
+		select {
+		case <-hup:
+			fmt.Println("Got SIGHUP, reloading", path)
+		case <-tick:
+			if t := fileModTime(path); !t.After(modTime) {
+				continue
+			}
+			fmt.Println("Config file changed, reloading", path)
+		}
+		modTime = fileModTime(path)
+		next, nextRegistry, err := loadConfig(path)
+		if err != nil {
+			fmt.Println("Keeping the current config:", err)
+			continue
+		}
+		for _, line := range diffPolicies(registry.Policies(), nextRegistry.Policies()) {
+			fmt.Println("Policy", line)
+		}
+		// cfg is still the config the server started with
+		for _, field := range cfg.restartNeeded(next) {
+			fmt.Printf("WARNING: %s changed, restart to apply it\n", field)
+		}
+		httpServer.SetPolicies(nextRegistry, next.StrictPolicies)
+		httpServer.SetTimeout(time.Duration(next.Timeout))
+		limiter.(reservationTTLSetter).SetReservationTTL(time.Duration(next.ReservationTTL))
+		registry = nextRegistry
+	}
+}
+
+func fileModTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
 }
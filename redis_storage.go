@@ -1,9 +1,10 @@
 package ratelimit
 
 import (
-	"bytes"
-	"encoding/gob"
+	"context"
+	"crypto/rand"
 	"errors"
+	"fmt"
 	"time"
 )
 
@@ -30,44 +31,50 @@ func NewRedisStorage(pool *redis.Pool, prefix string) *RedisStorage {
 	return &RedisStorage{pool, prefix}
 }
 
-func (rs *RedisStorage) Get(key string) (*TokenBucket, error) {
-	conn := rs.pool.Get()
-	defer conn.Close()
-	data, err := redis.Bytes(conn.Do("GET", rs.prefix+key))
+func (rs *RedisStorage) Get(ctx context.Context, key string) (*TokenBucket, error) {
+	var data []byte
+	err := withContext(ctx, func() error {
+		var err error
+		data, err = redis.Bytes(rs.do("GET", rs.prefix+key))
+		return err
+	})
 	if err == redis.ErrNil {
 		return nil, nil
 	} else if err != nil {
 		return nil, err
 	}
-	var bucket = new(TokenBucket)
-	dec := gob.NewDecoder(bytes.NewBuffer(data))
-	err = dec.Decode(bucket)
-	if err != nil {
-		return nil, err
-	}
-	return bucket, nil
+	return decodeBucket(data)
 }
 
-func (rs *RedisStorage) Set(key string, bucket *TokenBucket, duration time.Duration) error {
-	conn := rs.pool.Get()
-	defer conn.Close()
-	var buffer = bytes.NewBuffer(nil)
-	enc := gob.NewEncoder(buffer)
-	enc.Encode(bucket)
-	result, err := redis.String(conn.Do("SETEX", rs.prefix+key, int64(duration.Seconds()), buffer.Bytes()))
+func (rs *RedisStorage) Set(ctx context.Context, key string, bucket *TokenBucket, duration time.Duration) error {
+	data, err := encodeBucket(bucket)
+	if err != nil {
+		return err
+	}
+	var result string
+	err = withContext(ctx, func() error {
+		var err error
+		// Buckets may refill in less than a second, which SETEX cannot
+		// express
+		result, err = redis.String(rs.do("SET", rs.prefix+key, data, "PX", expireMillis(duration)))
+		return err
+	})
 	if err != nil {
 		return err
 	}
 	if result != "OK" {
-		return errors.New("redis: SETEX call failed")
+		return errors.New("redis: SET call failed")
 	}
 	return nil
 }
 
-func (rs *RedisStorage) Delete(key string) error {
-	conn := rs.pool.Get()
-	defer conn.Close()
-	result, err := redis.Int(conn.Do("DEL", rs.prefix+key))
+func (rs *RedisStorage) Delete(ctx context.Context, key string) error {
+	var result int
+	err := withContext(ctx, func() error {
+		var err error
+		result, err = redis.Int(rs.do("DEL", rs.prefix+key))
+		return err
+	})
 	if err != nil {
 		return err
 	}
@@ -76,3 +83,397 @@ func (rs *RedisStorage) Delete(key string) error {
 	}
 	return nil
 }
+
+// gcraKey is where the GCRA state of key is kept, apart from its bucket.
+func (rs *RedisStorage) gcraKey(key string) string {
+	return rs.prefix + "gcra:" + key
+}
+
+func (rs *RedisStorage) GetGCRA(ctx context.Context, key string) (*GCRAState, error) {
+	var value string
+	err := withContext(ctx, func() error {
+		var err error
+		value, err = redis.String(rs.do("GET", rs.gcraKey(key)))
+		return err
+	})
+	if err == redis.ErrNil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return parseGCRAState(value)
+}
+
+var compareAndSetGCRAScript = redis.NewScript(1, `
+local current = redis.call('GET', KEYS[1])
+if (current or '') ~= ARGV[1] then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[2], 'PX', ARGV[3])
+return 1
+`)
+
+func (rs *RedisStorage) CompareAndSetGCRA(ctx context.Context, key string, old, state *GCRAState, expire time.Duration) (bool, error) {
+	var current string
+	if old != nil {
+		current = old.String()
+	}
+	var swapped int
+	err := withContext(ctx, func() error {
+		var err error
+		swapped, err = redis.Int(rs.script(compareAndSetGCRAScript, rs.gcraKey(key), current, state.String(), expireMillis(expire)))
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	return swapped == 1, nil
+}
+
+func (rs *RedisStorage) DeleteGCRA(ctx context.Context, key string) error {
+	return withContext(ctx, func() error {
+		_, err := rs.do("DEL", rs.gcraKey(key))
+		return err
+	})
+}
+
+// The sliding window log of a key is a sorted set of its events, scored by
+// their time in microseconds, next to a string with its limit and
+// duration. Members carry the exact time, the count and a random suffix
+// that keeps events of the same time and count apart.
+func (rs *RedisStorage) logKeys(key string) (string, string) {
+	return rs.prefix + "log:" + key, rs.prefix + "logmeta:" + key
+}
+
+// getLogScript drops the events that are out of the stored window ending
+// at ARGV[1] microseconds. The stored duration is rounded up to whole
+// microseconds plus one, so no event within the window is dropped and
+// numbers stay exact in Lua.
+var getLogScript = redis.NewScript(2, `
+local meta = redis.call('GET', KEYS[2])
+if not meta then
+	return false
+end
+local duration = string.match(meta, '%d+$')
+local micros = 1
+if #duration > 3 then
+	micros = tonumber(string.sub(duration, 1, -4)) + 1
+end
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', string.format('(%.0f', tonumber(ARGV[1]) - micros))
+return {meta, redis.call('ZRANGE', KEYS[1], 0, -1)}
+`)
+
+// addEventScript sums the counts of the events within the window that
+// ends at the new one and only adds it if it fits under the limit. Events
+// in the microsecond the window starts in are told apart by the last
+// digits of their exact time, ARGV[8] nanoseconds into it.
+var addEventScript = redis.NewScript(2, `
+local used = tonumber(ARGV[5])
+local events = redis.call('ZRANGEBYSCORE', KEYS[1], ARGV[7], '+inf', 'WITHSCORES')
+for i = 1, #events, 2 do
+	local nanos, count = string.match(events[i], '^(%d+) (%d+) ')
+	if tonumber(events[i + 1]) > tonumber(ARGV[7]) or tonumber(string.sub(nanos, -3)) > tonumber(ARGV[8]) then
+		used = used + tonumber(count)
+	end
+end
+if used > tonumber(ARGV[6]) then
+	return 0
+end
+redis.call('ZADD', KEYS[1], ARGV[3], ARGV[4])
+redis.call('PEXPIRE', KEYS[1], ARGV[2])
+redis.call('SET', KEYS[2], ARGV[1], 'PX', ARGV[2])
+return 1
+`)
+
+var setLogScript = redis.NewScript(2, `
+redis.call('DEL', KEYS[1])
+for i = 3, #ARGV, 2 do
+	redis.call('ZADD', KEYS[1], ARGV[i], ARGV[i + 1])
+end
+redis.call('PEXPIRE', KEYS[1], ARGV[2])
+redis.call('SET', KEYS[2], ARGV[1], 'PX', ARGV[2])
+return 1
+`)
+
+func (rs *RedisStorage) GetLog(ctx context.Context, key string, now time.Time) (*EventLog, error) {
+	logKey, metaKey := rs.logKeys(key)
+	var values []interface{}
+	err := withContext(ctx, func() error {
+		var err error
+		values, err = redis.Values(rs.script(getLogScript, logKey, metaKey, now.UnixNano()/1000))
+		return err
+	})
+	if err == redis.ErrNil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if len(values) != 2 {
+		return nil, errors.New("redis: unexpected log reply")
+	}
+	meta, err := redis.String(values[0], nil)
+	if err != nil {
+		return nil, err
+	}
+	members, err := redis.Strings(values[1], nil)
+	if err != nil {
+		return nil, err
+	}
+	log := new(EventLog)
+	var duration int64
+	if _, err := fmt.Sscanf(meta, "%d %d", &log.Limit, &duration); err != nil {
+		return nil, fmt.Errorf("Invalid log meta '%s'", meta)
+	}
+	log.Duration = time.Duration(duration)
+	since := now.Add(-log.Duration)
+	for _, member := range members {
+		var nanos, count int64
+		var suffix string
+		if _, err := fmt.Sscanf(member, "%d %d %s", &nanos, &count, &suffix); err != nil {
+			return nil, fmt.Errorf("Invalid log event '%s'", member)
+		}
+		event := Event{time.Unix(0, nanos), count}
+		if event.Time.After(since) {
+			log.Events = append(log.Events, event)
+		}
+	}
+	return log, nil
+}
+
+func (rs *RedisStorage) AddEvent(ctx context.Context, key string, limit int64, duration time.Duration, event Event, expire time.Duration) (bool, error) {
+	logKey, metaKey := rs.logKeys(key)
+	score, member, err := logMember(event)
+	if err != nil {
+		return false, err
+	}
+	since := event.Time.Add(-duration).UnixNano()
+	var added int
+	err = withContext(ctx, func() error {
+		var err error
+		added, err = redis.Int(rs.script(addEventScript, logKey, metaKey, limitMeta(limit, duration), expireMillis(expire),
+			score, member, event.Count, limit, since/1000, since%1000))
+		return err
+	})
+	return added == 1, err
+}
+
+func (rs *RedisStorage) SetLog(ctx context.Context, key string, log *EventLog, expire time.Duration) error {
+	logKey, metaKey := rs.logKeys(key)
+	args := []interface{}{logKey, metaKey, limitMeta(log.Limit, log.Duration), expireMillis(expire)}
+	for _, event := range log.Events {
+		score, member, err := logMember(event)
+		if err != nil {
+			return err
+		}
+		args = append(args, score, member)
+	}
+	return withContext(ctx, func() error {
+		_, err := rs.script(setLogScript, args...)
+		return err
+	})
+}
+
+func (rs *RedisStorage) DeleteLog(ctx context.Context, key string) error {
+	logKey, metaKey := rs.logKeys(key)
+	return withContext(ctx, func() error {
+		_, err := rs.do("DEL", logKey, metaKey)
+		return err
+	})
+}
+
+func logMember(event Event) (int64, string, error) {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return 0, "", err
+	}
+	nanos := event.Time.UnixNano()
+	return nanos / 1000, fmt.Sprintf("%d %d %x", nanos, event.Count, suffix), nil
+}
+
+// Every window of a key has its own counter, next to a string with the
+// limit and duration of the key.
+func (rs *RedisStorage) counterKey(key string, start time.Time) string {
+	return fmt.Sprintf("%swin:%s:%d", rs.prefix, key, start.UnixNano())
+}
+
+func (rs *RedisStorage) counterMetaKey(key string) string {
+	return rs.prefix + "winmeta:" + key
+}
+
+var incrCounterScript = redis.NewScript(2, `
+local count = redis.call('INCRBY', KEYS[1], ARGV[1])
+if count < 0 then
+	redis.call('INCRBY', KEYS[1], -count)
+	count = 0
+end
+if redis.call('PTTL', KEYS[1]) < 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+redis.call('SET', KEYS[2], ARGV[3], 'PX', ARGV[2])
+return count
+`)
+
+func (rs *RedisStorage) GetCounters(ctx context.Context, key string, starts []time.Time) (*Counters, error) {
+	keys := []interface{}{rs.counterMetaKey(key)}
+	for _, start := range starts {
+		keys = append(keys, rs.counterKey(key, start))
+	}
+	var values []interface{}
+	err := withContext(ctx, func() error {
+		var err error
+		values, err = redis.Values(rs.do("MGET", keys...))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(values) != len(keys) {
+		return nil, errors.New("redis: unexpected MGET reply")
+	}
+	if values[0] == nil {
+		return nil, nil
+	}
+	meta, err := redis.String(values[0], nil)
+	if err != nil {
+		return nil, err
+	}
+	counters := &Counters{Counts: make([]int64, len(starts))}
+	var duration int64
+	if _, err := fmt.Sscanf(meta, "%d %d", &counters.Limit, &duration); err != nil {
+		return nil, fmt.Errorf("Invalid counter meta '%s'", meta)
+	}
+	counters.Duration = time.Duration(duration)
+	for i, value := range values[1:] {
+		if value == nil {
+			continue
+		}
+		counters.Counts[i], err = redis.Int64(value, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return counters, nil
+}
+
+func (rs *RedisStorage) IncrCounter(ctx context.Context, key string, start time.Time, delta, limit int64, duration, expire time.Duration) (int64, error) {
+	var count int64
+	err := withContext(ctx, func() error {
+		var err error
+		count, err = redis.Int64(rs.script(incrCounterScript, rs.counterKey(key, start), rs.counterMetaKey(key),
+			delta, expireMillis(expire), limitMeta(limit, duration)))
+		return err
+	})
+	return count, err
+}
+
+func (rs *RedisStorage) DeleteCounters(ctx context.Context, key string, starts []time.Time) error {
+	keys := []interface{}{rs.counterMetaKey(key)}
+	for _, start := range starts {
+		keys = append(keys, rs.counterKey(key, start))
+	}
+	return withContext(ctx, func() error {
+		_, err := rs.do("DEL", keys...)
+		return err
+	})
+}
+
+// The leases of a key are a sorted set of their ids, scored by their expiry
+// in milliseconds. The set expires along with its last lease.
+func (rs *RedisStorage) leaseKey(key string) string {
+	return rs.prefix + "lease:" + key
+}
+
+var acquireLeaseScript = redis.NewScript(1, `
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', ARGV[1])
+local held = redis.call('ZCARD', KEYS[1])
+local acquired = 0
+if held < tonumber(ARGV[2]) then
+	redis.call('ZADD', KEYS[1], ARGV[3], ARGV[4])
+	held = held + 1
+	acquired = 1
+end
+if held == 0 then
+	return {0, 0, 0, 0}
+end
+local first = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+local last = redis.call('ZRANGE', KEYS[1], -1, -1, 'WITHSCORES')
+redis.call('PEXPIREAT', KEYS[1], last[2])
+return {held, acquired, tonumber(first[2]), tonumber(last[2])}
+`)
+
+var releaseLeaseScript = redis.NewScript(1, `
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', ARGV[1])
+return redis.call('ZREM', KEYS[1], ARGV[2])
+`)
+
+func (rs *RedisStorage) AcquireLease(ctx context.Context, key, id string, limit int64, now, expires time.Time) (*Leases, bool, error) {
+	var values []int64
+	err := withContext(ctx, func() error {
+		var err error
+		values, err = redis.Int64s(rs.script(acquireLeaseScript, rs.leaseKey(key),
+			unixMillis(now, false), limit, unixMillis(expires, true), id))
+		return err
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if len(values) != 4 {
+		return nil, false, errors.New("redis: unexpected lease reply")
+	}
+	leases := &Leases{Held: values[0]}
+	if leases.Held > 0 {
+		leases.First = time.Unix(0, values[2]*int64(time.Millisecond))
+		leases.Last = time.Unix(0, values[3]*int64(time.Millisecond))
+	}
+	return leases, values[1] == 1, nil
+}
+
+func (rs *RedisStorage) ReleaseLease(ctx context.Context, key, id string, now time.Time) error {
+	var removed int
+	err := withContext(ctx, func() error {
+		var err error
+		removed, err = redis.Int(rs.script(releaseLeaseScript, rs.leaseKey(key), unixMillis(now, false), id))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if removed == 0 {
+		return ErrLeaseNotFound
+	}
+	return nil
+}
+
+// unixMillis returns t in whole milliseconds since the Unix epoch. Expiries
+// are rounded up and the times they are compared with are rounded down, so
+// that a lease never expires before its time.
+func unixMillis(t time.Time, up bool) int64 {
+	nanos := t.UnixNano()
+	if up {
+		nanos += int64(time.Millisecond) - 1
+	}
+	return nanos / int64(time.Millisecond)
+}
+
+// expireMillis rounds expire up to whole milliseconds, so that short
+// expiries do not become zero. It rounds after dividing, since expiries
+// that saturated at the longest duration would overflow otherwise.
+func expireMillis(expire time.Duration) int64 {
+	millis := int64(expire / time.Millisecond)
+	if expire%time.Millisecond > 0 {
+		millis++
+	}
+	return millis
+}
+
+func (rs *RedisStorage) do(commandName string, args ...interface{}) (interface{}, error) {
+	conn := rs.pool.Get()
+	defer conn.Close()
+	return conn.Do(commandName, args...)
+}
+
+func (rs *RedisStorage) script(script *redis.Script, keysAndArgs ...interface{}) (interface{}, error) {
+	conn := rs.pool.Get()
+	defer conn.Close()
+	return script.Do(conn, keysAndArgs...)
+}
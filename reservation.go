@@ -0,0 +1,101 @@
+package ratelimit
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrReservationNotFound = errors.New("Reservation not found")
+)
+
+const DefaultReservationTTL = time.Minute
+
+// A Reservation holds tokens that were consumed on behalf of a caller
+// until it either commits them or cancels the reservation to get them
+// refunded. Reservations that are neither committed nor cancelled before
+// Expires are dropped and their tokens stay consumed, so a client cannot
+// escape a limit by never finishing its reservations.
+type Reservation struct {
+	ID        string
+	Key       string
+	Algorithm string
+	Count     int64
+	Used      int64
+	Expires   time.Time
+}
+
+// reservations is the table of open reservations of a limiter.
+type reservations struct {
+	mu    sync.Mutex
+	ttl   time.Duration
+	clock Clock
+	data  map[string]*Reservation
+}
+
+func newReservations() *reservations {
+	return &reservations{ttl: DefaultReservationTTL, clock: SystemClock, data: make(map[string]*Reservation)}
+}
+
+func (r *reservations) setTTL(ttl time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ttl = ttl
+}
+
+func (r *reservations) setClock(clock Clock) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.clock = clock
+}
+
+func (r *reservations) add(key, algorithm string, count, used int64) (*Reservation, error) {
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.clock.Now()
+	r.expire(now)
+	reservation := &Reservation{id, key, algorithm, count, used, now.Add(r.ttl)}
+	r.data[id] = reservation
+	return reservation, nil
+}
+
+// take removes the reservation from the table and returns it, unless it
+// does not exist or has already expired.
+func (r *reservations) take(id string) (*Reservation, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	reservation, ok := r.data[id]
+	if ok == false {
+		return nil, ErrReservationNotFound
+	}
+	delete(r.data, id)
+	if !r.clock.Now().Before(reservation.Expires) {
+		return nil, ErrReservationNotFound
+	}
+	return reservation, nil
+}
+
+// expire drops the reservations that expired before now. It must be called
+// with r.mu held.
+func (r *reservations) expire(now time.Time) {
+	for id, reservation := range r.data {
+		if !now.Before(reservation.Expires) {
+			delete(r.data, id)
+		}
+	}
+}
+
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,92 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestReservationCommit(t *testing.T) {
+	storage := NewDummyStorage()
+	duration := time.Second * 100
+	limiter := NewSingleThreadLimiter(storage)
+	limiter.Start()
+	defer limiter.Stop()
+	reservation, err := limiter.Reserve(context.Background(), "testkey1", 3, 10, duration, Options{})
+	if err != nil {
+		t.Error(err)
+	}
+	if reservation.Used != 3 {
+		t.Error("There should be 3 token used", reservation.Used)
+	}
+	err = limiter.Commit(reservation.ID)
+	if err != nil {
+		t.Error(err)
+	}
+	result, _ := limiter.Get("testkey1")
+	if result.Used != 3 {
+		t.Error("There should be 3 token used", result.Used)
+	}
+	err = limiter.Commit(reservation.ID)
+	if err != ErrReservationNotFound {
+		t.Error("Reservation cannot be committed twice", err)
+	}
+}
+
+func TestReservationCancel(t *testing.T) {
+	storage := NewDummyStorage()
+	duration := time.Second * 100
+	limiter := NewSingleThreadLimiter(storage)
+	limiter.Start()
+	defer limiter.Stop()
+	limiter.Post("testkey1", 2, 10, duration)
+	reservation, err := limiter.Reserve(context.Background(), "testkey1", 5, 10, duration, Options{})
+	if err != nil {
+		t.Error(err)
+	}
+	if reservation.Used != 7 {
+		t.Error("There should be 7 token used", reservation.Used)
+	}
+	err = limiter.Cancel(context.Background(), reservation.ID)
+	if err != nil {
+		t.Error(err)
+	}
+	result, _ := limiter.Get("testkey1")
+	if result.Used != 2 {
+		t.Error("There should be 2 token used", result.Used)
+	}
+	err = limiter.Cancel(context.Background(), reservation.ID)
+	if err != ErrReservationNotFound {
+		t.Error("Reservation cannot be cancelled twice", err)
+	}
+}
+
+func TestReservationExpire(t *testing.T) {
+	storage := NewDummyStorage()
+	duration := time.Second * 100
+	clock := NewFakeClock(time.Now())
+	limiter := NewShardedLimiter(storage, 2)
+	limiter.SetClock(clock)
+	limiter.SetReservationTTL(time.Second)
+	reservation, err := limiter.Reserve(context.Background(), "testkey1", 5, 10, duration, Options{})
+	if err != nil {
+		t.Error(err)
+	}
+	clock.Advance(time.Second)
+	err = limiter.Cancel(context.Background(), reservation.ID)
+	if err != ErrReservationNotFound {
+		t.Error("Expired reservation cannot be cancelled", err)
+	}
+	result, _ := limiter.Get("testkey1")
+	if result.Used != 5 {
+		t.Error("Expired reservation should keep its tokens", result.Used)
+	}
+	// Adding a reservation drops the expired ones
+	limiter.Reserve(context.Background(), "testkey1", 1, 10, duration, Options{})
+	limiter.Reserve(context.Background(), "testkey1", 1, 10, duration, Options{})
+	clock.Advance(time.Second)
+	limiter.Reserve(context.Background(), "testkey1", 1, 10, duration, Options{})
+	if len(limiter.reservations.data) != 1 {
+		t.Error("There should be 1 open reservation", len(limiter.reservations.data))
+	}
+}
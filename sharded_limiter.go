@@ -0,0 +1,128 @@
+package ratelimit
+
+import (
+	"context"
+	"hash/fnv"
+	"sort"
+)
+
+// ShardedLimiter spreads keys over a fixed number of shards by hash.
+// Requests for keys in different shards run concurrently, while
+// requests for the same key are still serialized by the shard lock.
+type ShardedLimiter struct {
+	core
+	shards []chan struct{}
+}
+
+func NewShardedLimiter(storage Storage, shards int) *ShardedLimiter {
+	if shards < 1 {
+		shards = 1
+	}
+	l := &ShardedLimiter{
+		core:   newCore(storage),
+		shards: make([]chan struct{}, shards),
+	}
+	for i := range l.shards {
+		l.shards[i] = make(chan struct{}, 1)
+	}
+	l.dispatch = l.do
+	return l
+}
+
+// Shutdown stops accepting requests and waits for the ones in flight to
+// finish. New requests fail with ErrStopped.
+func (l *ShardedLimiter) Shutdown(ctx context.Context) error {
+	l.inflight.close()
+	done := make(chan int)
+	go func() {
+		l.inflight.wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// do runs req while holding the locks of the shards of its keys. Shard
+// locks are buffered channels so that waiting for one can be cancelled.
+// A request whose context is done while it runs keeps its locks until
+// it finishes in the background.
+func (l *ShardedLimiter) do(req request) response {
+	if !l.inflight.enter() {
+		return response{err: ErrStopped}
+	}
+	indexes := l.shardIndexes(req)
+	for i, index := range indexes {
+		select {
+		case l.shards[index] <- struct{}{}:
+		case <-req.ctx.Done():
+			l.unlock(indexes[:i])
+			l.inflight.leave()
+			return response{err: req.ctx.Err()}
+		}
+	}
+	if req.ctx.Done() == nil {
+		defer l.inflight.leave()
+		defer l.unlock(indexes)
+		return handle(l.storage, l.settings, req)
+	}
+	done := make(chan response, 1)
+	go func() {
+		defer l.inflight.leave()
+		defer l.unlock(indexes)
+		done <- handle(l.storage, l.settings, req)
+	}()
+	select {
+	case res := <-done:
+		return res
+	case <-req.ctx.Done():
+		return response{err: req.ctx.Err()}
+	}
+}
+
+func (l *ShardedLimiter) unlock(indexes []int) {
+	for _, index := range indexes {
+		<-l.shards[index]
+	}
+}
+
+// shardIndexes returns the shards of the keys of req. They are sorted so
+// that requests spanning several shards always lock them in the same
+// order and cannot deadlock each other.
+func (l *ShardedLimiter) shardIndexes(req request) []int {
+	var keys []string
+	switch req.method {
+	case MULTI:
+		for _, item := range req.items {
+			keys = append(keys, item.Key)
+		}
+	case WINDOWS:
+		// The windows are kept under keys of their own, which can be
+		// posted to directly as well
+		for _, window := range req.windows {
+			keys = append(keys, windowKey(req.key, window.Duration))
+		}
+	default:
+		return []int{l.shardIndex(req.key)}
+	}
+	seen := make(map[int]bool, len(keys))
+	indexes := make([]int, 0, len(keys))
+	for _, key := range keys {
+		index := l.shardIndex(key)
+		if !seen[index] {
+			seen[index] = true
+			indexes = append(indexes, index)
+		}
+	}
+	sort.Ints(indexes)
+	return indexes
+}
+
+func (l *ShardedLimiter) shardIndex(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(l.shards)))
+}
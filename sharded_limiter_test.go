@@ -0,0 +1,189 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestShardedLimiterPost(t *testing.T) {
+	storage := NewDummyStorage()
+	duration := time.Second * 100
+	limiter := NewShardedLimiter(storage, 4)
+	result, err := limiter.Post("testkey1", 1, 10, duration)
+	if err != nil {
+		t.Error(err)
+	}
+	if result.Used != 1 {
+		t.Error("There should be 1 token used", result.Used)
+	}
+	result, err = limiter.Post("testkey1", 1, 10, duration)
+	if err != nil {
+		t.Error(err)
+	}
+	if result.Used != 2 {
+		t.Error("There should be 2 token used", result.Used)
+	}
+	result, _ = limiter.Get("testkey1")
+	if result.Used != 2 {
+		t.Error("There should be 2 token used", result.Used)
+	}
+	err = limiter.Delete("testkey1")
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = limiter.Get("testkey1")
+	if err != ErrNotFound {
+		t.Error("Should return Not Found error", err)
+	}
+}
+
+func TestShardedLimiterMulti(t *testing.T) {
+	storage := NewDummyStorage()
+	duration := time.Second * 100
+	limiter := NewShardedLimiter(storage, 4)
+	keys := []string{"testkey1", "testkey2", "testkey3", "testkey4"}
+	sem := make(chan int)
+
+	for i := 0; i < 20; i++ {
+		go func(key string) {
+			_, err := limiter.Post(key, 1, 10, duration)
+			if err != nil {
+				t.Error(err)
+			}
+			sem <- 1
+		}(keys[i%len(keys)])
+	}
+
+	for i := 0; i < 20; i++ {
+		<-sem
+	}
+
+	for _, key := range keys {
+		bucket, _ := storage.Get(context.Background(), key)
+		if bucket.Used.Ceil() != 5 {
+			t.Error("Used should be 5", key, bucket)
+		}
+	}
+}
+
+func TestShardedLimiterWindows(t *testing.T) {
+	storage := NewDummyStorage()
+	limiter := NewShardedLimiter(storage, 16)
+	ctx := context.Background()
+	windows := []Window{{1000, time.Hour}, {1000, time.Hour * 24}}
+	sem := make(chan int)
+
+	// Windows are locked by their own keys, which are posted to directly
+	// at the same time
+	for i := 0; i < 40; i++ {
+		go func(i int) {
+			var err error
+			if i%2 == 0 {
+				_, _, err = limiter.PostWindows(ctx, "testkey1", 1, windows, Options{})
+			} else {
+				_, err = limiter.Post(windowKey("testkey1", time.Hour), 1, 1000, time.Hour)
+			}
+			if err != nil {
+				t.Error(err)
+			}
+			sem <- 1
+		}(i)
+	}
+
+	for i := 0; i < 40; i++ {
+		<-sem
+	}
+
+	bucket, _ := storage.Get(ctx, windowKey("testkey1", time.Hour))
+	if bucket.Used.Ceil() != 40 {
+		t.Error("Used should be 40", bucket)
+	}
+}
+
+func TestShardedLimiterZeroShards(t *testing.T) {
+	limiter := NewShardedLimiter(NewDummyStorage(), 0)
+	if len(limiter.shards) != 1 {
+		t.Error("There should be 1 shard", len(limiter.shards))
+	}
+	_, err := limiter.Post("testkey1", 1, 10, time.Second)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestShardedLimiterContextDeadline(t *testing.T) {
+	limiter := NewShardedLimiter(NewDummyStorage(), 1)
+	// Hold the only shard so the request has to wait for it
+	limiter.shards[0] <- struct{}{}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	_, err := limiter.PostContext(ctx, "testkey1", 1, 10, time.Second, Options{})
+	if err != context.DeadlineExceeded {
+		t.Error("Error should be context.DeadlineExceeded", err)
+	}
+	<-limiter.shards[0]
+	_, err = limiter.Post("testkey1", 1, 10, time.Second)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// slowStorage holds the writes of buckets until release is closed, like a
+// network storage that is slower than the timeout of requests.
+type slowStorage struct {
+	*DummyStorage
+	release chan struct{}
+}
+
+func (s *slowStorage) Set(ctx context.Context, key string, bucket *TokenBucket, expire time.Duration) error {
+	return withContext(ctx, func() error {
+		<-s.release
+		return s.DummyStorage.Set(ctx, key, bucket, expire)
+	})
+}
+
+func TestLimiterTimeoutKeepsKeySerialized(t *testing.T) {
+	storage := &slowStorage{DummyStorage: NewDummyStorage(), release: make(chan struct{})}
+	single := NewSingleThreadLimiter(storage)
+	single.Start()
+	defer single.Stop()
+	for _, limiter := range []Limiter{NewShardedLimiter(storage, 1), single} {
+		storage.release = make(chan struct{})
+		storage.Delete(context.Background(), "testkey1")
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+		_, err := limiter.PostContext(ctx, "testkey1", 1, 10, time.Hour, Options{})
+		cancel()
+		if err != context.DeadlineExceeded {
+			t.Error("Error should be context.DeadlineExceeded", err)
+		}
+		done := make(chan int)
+		go func() {
+			limiter.Post("testkey1", 1, 10, time.Hour)
+			close(done)
+		}()
+		time.Sleep(time.Millisecond * 10)
+		close(storage.release)
+		<-done
+		// The next post has to see the write of the one that timed out
+		if bucket, _ := storage.Get(context.Background(), "testkey1"); bucket.Used.Ceil() != 2 {
+			t.Error("Used should be 2", bucket)
+		}
+	}
+}
+
+func TestShardedLimiterShutdown(t *testing.T) {
+	limiter := NewShardedLimiter(NewDummyStorage(), 4)
+	_, err := limiter.Post("testkey1", 1, 10, time.Second)
+	if err != nil {
+		t.Error(err)
+	}
+	err = limiter.Shutdown(context.Background())
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = limiter.Post("testkey1", 1, 10, time.Second)
+	if err != ErrStopped {
+		t.Error("Error should be ErrStopped", err)
+	}
+}
@@ -0,0 +1,244 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// An Event is a request recorded by the sliding window log.
+type Event struct {
+	Time  time.Time
+	Count int64
+}
+
+// EventLog is what the sliding window log keeps per key: its events in
+// the order they happened, along with the limit and duration of the
+// latest one so that the usage can be read back without them.
+type EventLog struct {
+	Limit    int64
+	Duration time.Duration
+	Events   []Event
+}
+
+// LogStorage is implemented by the storages that can keep the event logs
+// of the sliding window log.
+type LogStorage interface {
+	// GetLog returns the log of key without the events that are out of
+	// its stored window ending at now, which the storage may drop. It
+	// returns nil for keys without a log.
+	GetLog(ctx context.Context, key string, now time.Time) (*EventLog, error)
+	// AddEvent appends event to the log of key and sets its limit and
+	// duration, unless the events of the log within the window of
+	// duration ending at the time of event leave no room for it under
+	// limit. It reports whether event was added, and checks and adds it
+	// atomically so that instances sharing the storage cannot both take
+	// the last tokens.
+	AddEvent(ctx context.Context, key string, limit int64, duration time.Duration, event Event, expire time.Duration) (bool, error)
+	// SetLog replaces the log of key.
+	SetLog(ctx context.Context, key string, log *EventLog, expire time.Duration) error
+	DeleteLog(ctx context.Context, key string) error
+}
+
+// window drops the events of log that are out of the window ending at now.
+func (log *EventLog) window(now time.Time) {
+	since := now.Add(-log.Duration)
+	i := 0
+	for i < len(log.Events) && !log.Events[i].Time.After(since) {
+		i++
+	}
+	log.Events = log.Events[i:]
+}
+
+// migrate changes the limit and duration of log as of now. Its events
+// leave the new window when they would have left the old one, but no
+// later than duration from now. Rescale instead keeps the share of the
+// window they had left and the share of the limit they use, rounded up.
+func (log *EventLog) migrate(limit int64, duration time.Duration, migration Migration, now time.Time) {
+	log.window(now)
+	for i := range log.Events {
+		event := &log.Events[i]
+		left := event.Time.Add(log.Duration).Sub(now)
+		if migration == Rescale {
+			left = saturate(mulDiv(uint64(left), uint64(duration), uint64(log.Duration), true))
+			count := mulDiv(uint64(event.Count), uint64(limit), uint64(log.Limit), true)
+			if count > math.MaxInt64 {
+				count = math.MaxInt64
+			}
+			event.Count = int64(count)
+		}
+		if left > duration {
+			left = duration
+		}
+		event.Time = now.Add(left - duration)
+	}
+	log.Limit, log.Duration = limit, duration
+}
+
+func (log *EventLog) used() int64 {
+	var used int64
+	for _, event := range log.Events {
+		used += event.Count
+	}
+	return used
+}
+
+// result describes log at now for a caller that wants count tokens. The
+// events of log must be within the window ending at now.
+func (log *EventLog) result(count int64, now time.Time) Result {
+	used := log.used()
+	remaining := log.Limit - used
+	if remaining < 0 {
+		remaining = 0
+	}
+	result := Result{
+		Used:      used,
+		Remaining: remaining,
+		Limit:     log.Limit,
+		Window:    log.Duration,
+		Reset:     now,
+	}
+	if len(log.Events) > 0 {
+		result.Reset = log.Events[len(log.Events)-1].Time.Add(log.Duration)
+	}
+	// Tokens come back only when the events that used them leave the
+	// window, oldest first
+	excess := used + count - log.Limit
+	for _, event := range log.Events {
+		if excess <= 0 {
+			break
+		}
+		excess -= event.Count
+		result.RetryAfter = event.Time.Add(log.Duration).Sub(now)
+	}
+	return result
+}
+
+// refund takes count tokens back from the newest events of log.
+func (log *EventLog) refund(count int64) {
+	i := len(log.Events)
+	for i > 0 && count > 0 {
+		event := &log.Events[i-1]
+		if event.Count > count {
+			event.Count -= count
+			break
+		}
+		count -= event.Count
+		i--
+	}
+	log.Events = log.Events[:i]
+}
+
+// slidingLogAlgorithm records every request with its time and lets at
+// most limit tokens through in any window of duration. Unlike the token
+// bucket, tokens only come back when the events that used them are
+// duration old, so limits hold exactly.
+type slidingLogAlgorithm struct{}
+
+func logStorage(storage Storage) (LogStorage, error) {
+	s, ok := storage.(LogStorage)
+	if !ok {
+		return nil, ErrAlgorithmNoStorage
+	}
+	return s, nil
+}
+
+func (slidingLogAlgorithm) post(storage Storage, settings settings, now time.Time, req request, peek bool) response {
+	s, err := logStorage(storage)
+	if err != nil {
+		return response{err: err}
+	}
+	log, err := getLog(req.ctx, s, req.key, now)
+	if err != nil {
+		return response{err: err}
+	}
+	// The events of a log whose limit or duration changed are rewritten,
+	// so clients cannot forget them by sending other parameters
+	migrated := false
+	if log == nil {
+		log = &EventLog{Limit: req.limit, Duration: req.duration}
+	} else if log.Limit != req.limit || log.Duration != req.duration {
+		log.migrate(req.limit, req.duration, settings.migration, now)
+		migrated = true
+	}
+
+	if log.used()+req.count > log.Limit {
+		return response{result: log.result(req.count, now), err: ErrLimitReached}
+	}
+	event := Event{now, req.count}
+	log.Events = append(log.Events, event)
+	if peek {
+		return response{result: log.result(0, now)}
+	}
+	added := true
+	if migrated {
+		err = s.SetLog(req.ctx, req.key, log, log.Duration)
+	} else {
+		added, err = s.AddEvent(req.ctx, req.key, log.Limit, log.Duration, event, log.Duration)
+	}
+	if err != nil {
+		return response{err: err}
+	}
+	if !added {
+		// Other posts took the tokens since the log was read
+		log, err = getLog(req.ctx, s, req.key, now)
+		if err != nil || log == nil {
+			return response{err: err}
+		}
+		return response{result: log.result(req.count, now), err: ErrLimitReached}
+	}
+	return response{result: log.result(0, now)}
+}
+
+// getLog returns the log of key within its window as of now.
+func getLog(ctx context.Context, s LogStorage, key string, now time.Time) (*EventLog, error) {
+	log, err := s.GetLog(ctx, key, now)
+	if err != nil || log == nil {
+		return nil, err
+	}
+	log.window(now)
+	return log, nil
+}
+
+func (slidingLogAlgorithm) get(storage Storage, _ settings, now time.Time, req request) response {
+	s, err := logStorage(storage)
+	if err != nil {
+		return response{err: err}
+	}
+	log, err := getLog(req.ctx, s, req.key, now)
+	if err != nil {
+		return response{err: err}
+	}
+	if log == nil {
+		return response{err: ErrNotFound}
+	}
+	return response{result: log.result(req.count, now)}
+}
+
+func (slidingLogAlgorithm) refund(storage Storage, _ settings, now time.Time, req request) response {
+	s, err := logStorage(storage)
+	if err != nil {
+		return response{err: err}
+	}
+	log, err := getLog(req.ctx, s, req.key, now)
+	if err != nil {
+		return response{err: err}
+	}
+	if log == nil {
+		return response{err: ErrNotFound}
+	}
+	log.refund(req.count)
+	err = s.SetLog(req.ctx, req.key, log, log.Duration)
+	if err != nil {
+		return response{err: err}
+	}
+	return response{result: log.result(0, now)}
+}
+
+func (slidingLogAlgorithm) remove(storage Storage, _ settings, _ time.Time, req request) response {
+	s, err := logStorage(storage)
+	if err != nil {
+		return response{err: err}
+	}
+	return response{err: s.DeleteLog(req.ctx, req.key)}
+}
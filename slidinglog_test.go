@@ -0,0 +1,164 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSlidingLog(t *testing.T) {
+	storage := NewDummyStorage()
+	clock := NewFakeClock(time.Now())
+	limiter := NewSingleThreadLimiter(storage)
+	limiter.SetClock(clock)
+	limiter.Start()
+	defer limiter.Stop()
+	ctx := context.Background()
+	opts := Options{Algorithm: AlgorithmSlidingLog}
+	duration := time.Hour * 24
+	for i := int64(1); i <= 5; i++ {
+		result, err := limiter.PostContext(ctx, "testkey1", 1, 5, duration, opts)
+		if err != nil || result.Used != i {
+			t.Error("Used should be", i, result, err)
+		}
+		clock.Advance(time.Hour)
+	}
+	// A token bucket would have refilled about one token by now
+	clock.Advance(time.Hour * 10)
+	result, err := limiter.PostContext(ctx, "testkey1", 1, 5, duration, opts)
+	if err != ErrLimitReached {
+		t.Error("Limit should be reached for the whole window", result, err)
+	}
+	if result.RetryAfter != time.Hour*9 {
+		t.Error("RetryAfter should be when the first event leaves the window", result.RetryAfter)
+	}
+	result, err = limiter.GetResult(ctx, "testkey1", 3, opts)
+	if err != nil || result.Used != 5 || result.RetryAfter != time.Hour*11 {
+		t.Error("Three tokens should be back when the third event leaves", result, err)
+	}
+
+	clock.Advance(time.Hour * 9)
+	result, err = limiter.PostContext(ctx, "testkey1", 1, 5, duration, opts)
+	if err != nil || result.Used != 5 {
+		t.Error("The first event should have left the window", result, err)
+	}
+}
+
+// racingLogStorage lets another instance post count tokens between the
+// read and the add of the next post.
+type racingLogStorage struct {
+	*DummyStorage
+	count int64
+	raced bool
+}
+
+func (s *racingLogStorage) AddEvent(ctx context.Context, key string, limit int64, duration time.Duration, event Event, expire time.Duration) (bool, error) {
+	if !s.raced {
+		s.raced = true
+		s.DummyStorage.AddEvent(ctx, key, limit, duration, Event{event.Time, s.count}, expire)
+	}
+	return s.DummyStorage.AddEvent(ctx, key, limit, duration, event, expire)
+}
+
+func TestSlidingLogConcurrentAdd(t *testing.T) {
+	storage := &racingLogStorage{DummyStorage: NewDummyStorage(), count: 3, raced: true}
+	clock := NewFakeClock(time.Now())
+	limiter := NewShardedLimiter(storage, 1)
+	limiter.SetClock(clock)
+	ctx := context.Background()
+	opts := Options{Algorithm: AlgorithmSlidingLog}
+	limiter.PostContext(ctx, "testkey1", 1, 5, time.Hour*24, opts)
+	storage.raced = false
+	result, err := limiter.PostContext(ctx, "testkey1", 2, 5, time.Hour*24, opts)
+	if err != ErrLimitReached || result.Used != 4 {
+		t.Error("An event without room should not be added", result, err)
+	}
+	result, err = limiter.PostContext(ctx, "testkey1", 1, 5, time.Hour*24, opts)
+	if err != nil || result.Used != 5 {
+		t.Error("Post should pass on top of the other instance", result, err)
+	}
+}
+
+func TestSlidingLogRefundAndDelete(t *testing.T) {
+	storage := NewDummyStorage()
+	clock := NewFakeClock(time.Now())
+	limiter := NewShardedLimiter(storage, 4)
+	limiter.SetClock(clock)
+	ctx := context.Background()
+	opts := Options{Algorithm: AlgorithmSlidingLog}
+	duration := time.Second * 10
+	limiter.PostContext(ctx, "testkey1", 3, 10, duration, opts)
+	clock.Advance(time.Second)
+	limiter.PostContext(ctx, "testkey1", 3, 10, duration, opts)
+	result, err := limiter.RefundContext(ctx, "testkey1", 4, opts)
+	if err != nil || result.Used != 2 {
+		t.Error("Used should be 2", result, err)
+	}
+	if log, _ := storage.GetLog(ctx, "testkey1", clock.Now()); len(log.Events) != 1 || log.Events[0].Count != 2 {
+		t.Error("Refund should take the newest events back first", log)
+	}
+	result, err = limiter.Peek(ctx, "testkey1", 8, 10, duration, opts)
+	if err != nil || result.Used != 10 {
+		t.Error("Peek should see 10 used", result, err)
+	}
+	if result, _ = limiter.GetResult(ctx, "testkey1", 1, opts); result.Used != 2 {
+		t.Error("Peek should not consume", result)
+	}
+	if err := limiter.DeleteContext(ctx, "testkey1", opts); err != nil {
+		t.Error(err)
+	}
+	if _, err := limiter.GetContext(ctx, "testkey1", opts); err != ErrNotFound {
+		t.Error("Key should be deleted", err)
+	}
+}
+
+func TestSlidingLogLimitChange(t *testing.T) {
+	storage := NewDummyStorage()
+	clock := NewFakeClock(time.Now())
+	limiter := NewShardedLimiter(storage, 1)
+	limiter.SetClock(clock)
+	ctx := context.Background()
+	opts := Options{Algorithm: AlgorithmSlidingLog}
+	limiter.PostContext(ctx, "testkey1", 4, 5, time.Minute, opts)
+	result, err := limiter.PostContext(ctx, "testkey1", 1, 4, time.Minute, opts)
+	if err != ErrLimitReached || result.Used != 4 {
+		t.Error("Events should count against the new limit", result, err)
+	}
+	clock.Advance(time.Second * 30)
+	result, err = limiter.PostContext(ctx, "testkey1", 1, 10, time.Second*20, opts)
+	if err != nil || result.Used != 5 || result.Reset != clock.Now().Add(time.Second*20) {
+		t.Error("Events should be carried into the new window", result, err)
+	}
+	clock.Advance(time.Second * 20)
+	result, err = limiter.PostContext(ctx, "testkey1", 1, 10, time.Second*20, opts)
+	if err != nil || result.Used != 1 {
+		t.Error("Events should leave the new window", result, err)
+	}
+}
+
+func TestSlidingLogDurationChange(t *testing.T) {
+	storage := NewDummyStorage()
+	clock := NewFakeClock(time.Now())
+	limiter := NewShardedLimiter(storage, 1)
+	limiter.SetClock(clock)
+	ctx := context.Background()
+	opts := Options{Algorithm: AlgorithmSlidingLog}
+	duration := time.Hour * 24
+	limiter.PostContext(ctx, "testkey1", 5, 5, duration, opts)
+	clock.Advance(time.Hour)
+	result, err := limiter.PostContext(ctx, "testkey1", 1, 5, time.Second, opts)
+	if err != ErrLimitReached || result.Used != 5 {
+		t.Error("A shorter duration should not forget the events", result, err)
+	}
+	result, err = limiter.PostContext(ctx, "testkey1", 1, 5, duration, opts)
+	if err != ErrLimitReached || result.RetryAfter != time.Hour*23 {
+		t.Error("The log should keep its window", result, err)
+	}
+
+	limiter.SetMigration(Rescale)
+	clock.Advance(time.Hour * 11)
+	result, err = limiter.PostContext(ctx, "testkey1", 1, 10, time.Hour*48, opts)
+	if err != ErrLimitReached || result.Used != 10 || result.RetryAfter != time.Hour*24 {
+		t.Error("Rescale should keep the shares of the window and the limit", result, err)
+	}
+}
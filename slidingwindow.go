@@ -0,0 +1,285 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// Counters is what the window algorithms read for a key: the limit and
+// duration it was last posted with and the counts of some of its windows.
+type Counters struct {
+	Limit    int64
+	Duration time.Duration
+	Counts   []int64
+}
+
+// CounterStorage is implemented by the storages that can keep the
+// counters of the window algorithms, one per key and window start.
+type CounterStorage interface {
+	// GetCounters returns the counts of the windows of key that start at
+	// starts, zero for windows without a count. It returns nil for keys
+	// without a limit and duration.
+	GetCounters(ctx context.Context, key string, starts []time.Time) (*Counters, error)
+	// IncrCounter adds delta to the count of the window of key that starts
+	// at start and returns the new count, which never drops below zero. A
+	// new count expires after expire. The limit and duration of key are
+	// set along with it and expire after expire too.
+	IncrCounter(ctx context.Context, key string, start time.Time, delta, limit int64, duration time.Duration, expire time.Duration) (int64, error)
+	DeleteCounters(ctx context.Context, key string, starts []time.Time) error
+}
+
+func counterStorage(storage Storage) (CounterStorage, error) {
+	s, ok := storage.(CounterStorage)
+	if !ok {
+		return nil, ErrAlgorithmNoStorage
+	}
+	return s, nil
+}
+
+// windowStart returns the start of the window of duration that now is in,
+// with windows aligned to the Unix epoch.
+func windowStart(now time.Time, duration time.Duration) time.Time {
+	nanos := now.UnixNano()
+	offset := nanos % int64(duration)
+	if offset < 0 {
+		offset += int64(duration)
+	}
+	return time.Unix(0, nanos-offset)
+}
+
+// windowEpsilon absorbs the rounding errors of weighted counts, so that
+// a window that is exactly full is not taken for an overflowing one.
+const windowEpsilon = 1e-9
+
+// slidingWindow is the state of a key under the sliding window counter:
+// the counts of the window now is in and of the one before it.
+type slidingWindow struct {
+	limit    int64
+	duration time.Duration
+	start    time.Time
+	previous int64
+	current  int64
+}
+
+// estimate weighs the previous count by how much of the previous window
+// still overlaps the window of duration ending at now.
+func (w *slidingWindow) estimate(now time.Time) float64 {
+	weight := 1 - float64(now.Sub(w.start))/float64(w.duration)
+	return float64(w.previous)*weight + float64(w.current)
+}
+
+func (w *slidingWindow) fits(count int64, now time.Time) bool {
+	return w.estimate(now)+float64(count) <= float64(w.limit)+windowEpsilon
+}
+
+// waitTime returns how long after now count more tokens fit under the
+// limit. It is zero if they fit now.
+func (w *slidingWindow) waitTime(count int64, now time.Time) time.Duration {
+	if w.fits(count, now) {
+		return 0
+	}
+	start, previous, current := w.start, float64(w.previous), float64(w.current)
+	if w.current+count > w.limit {
+		// Not before the next window, where the current count becomes
+		// the previous one
+		start, previous, current = start.Add(w.duration), current, 0
+	}
+	room := float64(w.limit-count) - current
+	if room < 0 {
+		// More than the limit is never available at once
+		return start.Add(w.duration).Sub(now)
+	}
+	var elapsed float64
+	if previous > room {
+		elapsed = float64(w.duration) * (1 - room/previous)
+	}
+	wait := start.Add(time.Duration(math.Ceil(elapsed))).Sub(now)
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// migrate changes the limit and duration of w as of now. The tokens it
+// uses are carried into the window of the new duration that now is in, or
+// their share of the limit with Rescale, rounded up.
+func (w *slidingWindow) migrate(limit int64, duration time.Duration, migration Migration, now time.Time) {
+	used := w.estimate(now) - windowEpsilon
+	if migration == Rescale {
+		used = used * float64(limit) / float64(w.limit)
+	}
+	carried := usage(used)
+	if carried < 0 {
+		carried = 0
+	}
+	w.limit, w.duration = limit, duration
+	w.start = windowStart(now, duration)
+	w.previous, w.current = 0, carried
+}
+
+// starts returns the starts of the previous and the current window of w.
+func (w *slidingWindow) starts() []time.Time {
+	return []time.Time{w.start.Add(-w.duration), w.start}
+}
+
+// result describes w at now for a caller that wants count tokens.
+func (w *slidingWindow) result(count int64, now time.Time) Result {
+	used := usage(w.estimate(now) - windowEpsilon)
+	if used < 0 {
+		used = 0
+	}
+	remaining := w.limit - used
+	if remaining < 0 {
+		remaining = 0
+	}
+	reset := now
+	if w.current > 0 {
+		reset = w.start.Add(2 * w.duration)
+	} else if w.previous > 0 {
+		reset = w.start.Add(w.duration)
+	}
+	return Result{
+		Used:       used,
+		Remaining:  remaining,
+		Limit:      w.limit,
+		Window:     w.duration,
+		Reset:      reset,
+		RetryAfter: w.waitTime(count, now),
+	}
+}
+
+// slidingWindowAlgorithm approximates the sliding window log with two
+// counters per key: the count of the previous window, weighted by how much
+// of it overlaps the window ending now, plus the count of the current
+// window. It keeps two integers per key whatever the traffic, at the cost
+// of assuming that the previous window was used evenly.
+type slidingWindowAlgorithm struct{}
+
+// loadSlidingWindow reads the counters of key that matter at now.
+func loadSlidingWindow(ctx context.Context, s CounterStorage, key string, limit int64, duration time.Duration, now time.Time) (*slidingWindow, error) {
+	w := &slidingWindow{limit: limit, duration: duration, start: windowStart(now, duration)}
+	counters, err := s.GetCounters(ctx, key, w.starts())
+	if err != nil {
+		return nil, err
+	}
+	if counters != nil {
+		w.previous, w.current = counters.Counts[0], counters.Counts[1]
+	}
+	return w, nil
+}
+
+// loadStoredSlidingWindow is loadSlidingWindow with the limit and
+// duration key was last posted with.
+func loadStoredSlidingWindow(ctx context.Context, s CounterStorage, key string, now time.Time) (*slidingWindow, error) {
+	counters, err := s.GetCounters(ctx, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	if counters == nil {
+		return nil, ErrNotFound
+	}
+	return loadSlidingWindow(ctx, s, key, counters.Limit, counters.Duration, now)
+}
+
+func (slidingWindowAlgorithm) post(storage Storage, settings settings, now time.Time, req request, peek bool) response {
+	s, err := counterStorage(storage)
+	if err != nil {
+		return response{err: err}
+	}
+	key := stateKey(AlgorithmSlidingWindow, req.key)
+	w, err := loadStoredSlidingWindow(req.ctx, s, key, now)
+	if err == ErrNotFound {
+		w, err = &slidingWindow{limit: req.limit, duration: req.duration, start: windowStart(now, req.duration)}, nil
+	}
+	if err != nil {
+		return response{err: err}
+	}
+	// Windows of another duration start elsewhere, so the usage of a key
+	// whose limit or duration changed is carried into new ones
+	var stale []time.Time
+	if w.limit != req.limit || w.duration != req.duration {
+		stale = w.starts()
+		w.migrate(req.limit, req.duration, settings.migration, now)
+		stale = append(stale, w.starts()...)
+	}
+	if !w.fits(req.count, now) {
+		return response{result: w.result(req.count, now), err: ErrLimitReached}
+	}
+	if peek {
+		w.current += req.count
+		return response{result: w.result(0, now)}
+	}
+	delta := req.count
+	if stale != nil {
+		// The carried usage replaces the windows of both durations,
+		// including counts left by earlier posts with the new one
+		err = s.DeleteCounters(req.ctx, key, stale)
+		if err != nil {
+			return response{err: err}
+		}
+		delta += w.current
+	}
+	// A count lives on as the previous one for another window
+	w.current, err = s.IncrCounter(req.ctx, key, w.start, delta, w.limit, w.duration, 2*w.duration)
+	if err != nil {
+		return response{err: err}
+	}
+	if !w.fits(0, now) {
+		// Other posts took the tokens since the counts were read, so the
+		// increment is taken back
+		w.current, err = s.IncrCounter(req.ctx, key, w.start, -req.count, w.limit, w.duration, 2*w.duration)
+		if err != nil {
+			return response{err: err}
+		}
+		return response{result: w.result(req.count, now), err: ErrLimitReached}
+	}
+	return response{result: w.result(0, now)}
+}
+
+func (slidingWindowAlgorithm) get(storage Storage, _ settings, now time.Time, req request) response {
+	s, err := counterStorage(storage)
+	if err != nil {
+		return response{err: err}
+	}
+	key := stateKey(AlgorithmSlidingWindow, req.key)
+	w, err := loadStoredSlidingWindow(req.ctx, s, key, now)
+	if err != nil {
+		return response{err: err}
+	}
+	return response{result: w.result(req.count, now)}
+}
+
+// refund only takes tokens back from the current window. Tokens used in
+// the previous window are on their way out anyway.
+func (slidingWindowAlgorithm) refund(storage Storage, _ settings, now time.Time, req request) response {
+	s, err := counterStorage(storage)
+	if err != nil {
+		return response{err: err}
+	}
+	key := stateKey(AlgorithmSlidingWindow, req.key)
+	w, err := loadStoredSlidingWindow(req.ctx, s, key, now)
+	if err != nil {
+		return response{err: err}
+	}
+	w.current, err = s.IncrCounter(req.ctx, key, w.start, -req.count, w.limit, w.duration, 2*w.duration)
+	if err != nil {
+		return response{err: err}
+	}
+	return response{result: w.result(0, now)}
+}
+
+func (slidingWindowAlgorithm) remove(storage Storage, _ settings, now time.Time, req request) response {
+	s, err := counterStorage(storage)
+	if err != nil {
+		return response{err: err}
+	}
+	key := stateKey(AlgorithmSlidingWindow, req.key)
+	counters, err := s.GetCounters(req.ctx, key, nil)
+	if err != nil || counters == nil {
+		return response{err: err}
+	}
+	// Older windows no longer count and expire on their own
+	w := &slidingWindow{duration: counters.Duration, start: windowStart(now, counters.Duration)}
+	return response{err: s.DeleteCounters(req.ctx, key, w.starts())}
+}
@@ -0,0 +1,185 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSlidingWindow(t *testing.T) {
+	storage := NewDummyStorage()
+	// Windows are aligned to the epoch, so start right at one
+	clock := NewFakeClock(time.Unix(1500000000, 0))
+	limiter := NewSingleThreadLimiter(storage)
+	limiter.SetClock(clock)
+	limiter.Start()
+	defer limiter.Stop()
+	ctx := context.Background()
+	opts := Options{Algorithm: AlgorithmSlidingWindow}
+	result, err := limiter.PostContext(ctx, "testkey1", 10, 10, time.Minute, opts)
+	if err != nil || result.Used != 10 {
+		t.Error("Used should be 10", result, err)
+	}
+	result, err = limiter.PostContext(ctx, "testkey1", 1, 10, time.Minute, opts)
+	if err != ErrLimitReached {
+		t.Error("Limit should be reached", err)
+	}
+	// In the next window the 10 tokens weigh 9 once 6s of it passed
+	if result.RetryAfter != time.Second*66 {
+		t.Error("RetryAfter should be 66s", result.RetryAfter)
+	}
+	clock.Advance(time.Second * 65)
+	if _, err := limiter.PostContext(ctx, "testkey1", 1, 10, time.Minute, opts); err != ErrLimitReached {
+		t.Error("Limit should still be reached", err)
+	}
+	clock.Advance(time.Second)
+	result, err = limiter.PostContext(ctx, "testkey1", 1, 10, time.Minute, opts)
+	if err != nil || result.Used != 10 {
+		t.Error("Post should pass at RetryAfter", result, err)
+	}
+	if !result.Reset.Equal(time.Unix(1500000000, 0).Add(time.Minute * 3)) {
+		t.Error("Reset should be the end of the next window", result.Reset)
+	}
+	clock.Advance(time.Second * 24)
+	result, err = limiter.GetContext(ctx, "testkey1", opts)
+	if err != nil || result.Used != 6 {
+		t.Error("Half of the previous window should count", result, err)
+	}
+}
+
+func TestSlidingWindowDurationChange(t *testing.T) {
+	storage := NewDummyStorage()
+	clock := NewFakeClock(time.Unix(1500000000, 0).Truncate(time.Hour))
+	limiter := NewShardedLimiter(storage, 1)
+	limiter.SetClock(clock)
+	ctx := context.Background()
+	opts := Options{Algorithm: AlgorithmSlidingWindow}
+	limiter.PostContext(ctx, "testkey1", 5, 5, time.Hour, opts)
+	clock.Advance(time.Minute)
+	result, err := limiter.PostContext(ctx, "testkey1", 1, 5, time.Minute*59, opts)
+	if err != ErrLimitReached || result.Used != 5 {
+		t.Error("Another duration should not start from zero", result, err)
+	}
+	result, err = limiter.PostContext(ctx, "testkey1", 1, 10, time.Minute*59, opts)
+	if err != nil || result.Used != 6 {
+		t.Error("The usage should be carried into the new windows", result, err)
+	}
+	result, err = limiter.PostContext(ctx, "testkey1", 1, 10, time.Hour, opts)
+	if err != nil || result.Used != 7 {
+		t.Error("Old counts of the new duration should be replaced", result, err)
+	}
+
+	limiter.SetMigration(Rescale)
+	result, err = limiter.PostContext(ctx, "testkey1", 1, 20, time.Hour, opts)
+	if err != nil || result.Used != 15 {
+		t.Error("Rescale should keep the share of the limit", result, err)
+	}
+}
+
+func TestSlidingWindowConcurrentIncrement(t *testing.T) {
+	storage := &racingCounterStorage{DummyStorage: NewDummyStorage(), count: 3, raced: true}
+	clock := NewFakeClock(time.Unix(1500000000, 0))
+	limiter := NewShardedLimiter(storage, 1)
+	limiter.SetClock(clock)
+	ctx := context.Background()
+	opts := Options{Algorithm: AlgorithmSlidingWindow}
+	limiter.PostContext(ctx, "testkey1", 1, 5, time.Minute, opts)
+	storage.raced = false
+	result, err := limiter.PostContext(ctx, "testkey1", 2, 5, time.Minute, opts)
+	if err != ErrLimitReached || result.Used != 4 {
+		t.Error("An increment over the limit should be taken back", result, err)
+	}
+	result, err = limiter.PostContext(ctx, "testkey1", 1, 5, time.Minute, opts)
+	if err != nil || result.Used != 5 {
+		t.Error("Post should pass on top of the other instance", result, err)
+	}
+}
+
+func TestSlidingWindowRefundAndDelete(t *testing.T) {
+	storage := NewDummyStorage()
+	clock := NewFakeClock(time.Unix(1500000000, 0))
+	limiter := NewShardedLimiter(storage, 4)
+	limiter.SetClock(clock)
+	ctx := context.Background()
+	opts := Options{Algorithm: AlgorithmSlidingWindow}
+	duration := time.Second * 10
+	limiter.PostContext(ctx, "testkey1", 6, 10, duration, opts)
+	result, err := limiter.RefundContext(ctx, "testkey1", 4, opts)
+	if err != nil || result.Used != 2 {
+		t.Error("Used should be 2", result, err)
+	}
+	result, err = limiter.RefundContext(ctx, "testkey1", 4, opts)
+	if err != nil || result.Used != 0 {
+		t.Error("Usage should not drop below zero", result, err)
+	}
+	result, err = limiter.Peek(ctx, "testkey1", 8, 10, duration, opts)
+	if err != nil || result.Used != 8 {
+		t.Error("Peek should see 8 used", result, err)
+	}
+	if result, _ = limiter.GetResult(ctx, "testkey1", 1, opts); result.Used != 0 {
+		t.Error("Peek should not consume", result)
+	}
+	if err := limiter.DeleteContext(ctx, "testkey1", opts); err != nil {
+		t.Error(err)
+	}
+	if _, err := limiter.GetContext(ctx, "testkey1", opts); err != ErrNotFound {
+		t.Error("Key should be deleted", err)
+	}
+}
+
+// The counter assumes the previous window was used evenly. Compare it to
+// the exact log under steady traffic, where that holds, and under bursts,
+// where it does not.
+func TestSlidingWindowAccuracy(t *testing.T) {
+	storage := NewDummyStorage()
+	clock := NewFakeClock(time.Unix(1500000000, 0))
+	limiter := NewShardedLimiter(storage, 1)
+	limiter.SetClock(clock)
+	windowOpts := Options{Algorithm: AlgorithmSlidingWindow}
+	logOpts := Options{Algorithm: AlgorithmSlidingLog}
+	compare := func(key string, limit int64, posts func(second int) int64) (maxDiff int64, windowPassed, logPassed int64) {
+		for second := 0; second < 600; second++ {
+			for i := posts(second); i > 0; i-- {
+				if _, err := limiter.PostContext(context.Background(), key, 1, limit, time.Minute, windowOpts); err == nil {
+					windowPassed++
+				}
+				if _, err := limiter.PostContext(context.Background(), key, 1, limit, time.Minute, logOpts); err == nil {
+					logPassed++
+				}
+			}
+			windowResult, _ := limiter.GetContext(context.Background(), key, windowOpts)
+			logResult, _ := limiter.GetContext(context.Background(), key, logOpts)
+			diff := windowResult.Used - logResult.Used
+			if diff < 0 {
+				diff = -diff
+			}
+			if diff > maxDiff {
+				maxDiff = diff
+			}
+			clock.Advance(time.Second)
+		}
+		return
+	}
+
+	maxDiff, windowPassed, logPassed := compare("steady", 1000, func(int) int64 { return 5 })
+	if maxDiff > 5 || windowPassed != logPassed {
+		t.Error("Steady traffic should be counted almost exactly", maxDiff, windowPassed, logPassed)
+	}
+
+	// 100 tokens asked for in the first 10s of every minute, against a
+	// limit of 60
+	maxDiff, windowPassed, logPassed = compare("bursty", 60, func(second int) int64 {
+		if second%60 < 10 {
+			return 10
+		}
+		return 0
+	})
+	if maxDiff > 60 {
+		t.Error("Usage should never be off by more than the limit", maxDiff)
+	}
+	// Bursts right after a busy window still see most of it, so the
+	// counter errs on the strict side
+	if windowPassed > logPassed || windowPassed < logPassed/2 {
+		t.Error("Bursts should let through between half and all of the exact log", windowPassed, logPassed)
+	}
+}
@@ -1,7 +1,10 @@
 package ratelimit
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"sync"
 	"time"
 )
 
@@ -10,20 +13,41 @@ var (
 )
 
 type Storage interface {
-	Get(key string) (*TokenBucket, error)
-	Set(key string, bucket *TokenBucket, expire time.Duration) error
-	Delete(key string) error
+	Get(ctx context.Context, key string) (*TokenBucket, error)
+	Set(ctx context.Context, key string, bucket *TokenBucket, expire time.Duration) error
+	Delete(ctx context.Context, key string) error
 }
 
 type DummyStorage struct {
+	mu   sync.RWMutex
 	data map[string]*TokenBucket
+	gcra map[string]GCRAState
+	logs map[string]*EventLog
+	// counters of every key by window start, along with the limit and
+	// duration of the key in its Counters
+	counters map[string]*dummyCounters
+	// expiry of every lease by key and id
+	leases map[string]map[string]time.Time
+}
+
+type dummyCounters struct {
+	Counters
+	windows map[int64]int64
 }
 
 func NewDummyStorage() *DummyStorage {
-	return &DummyStorage{make(map[string]*TokenBucket)}
+	return &DummyStorage{
+		data:     make(map[string]*TokenBucket),
+		gcra:     make(map[string]GCRAState),
+		logs:     make(map[string]*EventLog),
+		counters: make(map[string]*dummyCounters),
+		leases:   make(map[string]map[string]time.Time),
+	}
 }
 
-func (d *DummyStorage) Get(key string) (*TokenBucket, error) {
+func (d *DummyStorage) Get(_ context.Context, key string) (*TokenBucket, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
 	b, ok := d.data[key]
 	if ok == false {
 		return nil, nil
@@ -31,12 +55,210 @@ func (d *DummyStorage) Get(key string) (*TokenBucket, error) {
 	return b, nil
 }
 
-func (d *DummyStorage) Set(key string, bucket *TokenBucket, _ time.Duration) error {
+func (d *DummyStorage) Set(_ context.Context, key string, bucket *TokenBucket, _ time.Duration) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	d.data[key] = bucket
 	return nil
 }
 
-func (d *DummyStorage) Delete(key string) error {
+func (d *DummyStorage) Delete(_ context.Context, key string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	delete(d.data, key)
 	return nil
 }
+
+func (d *DummyStorage) GetGCRA(_ context.Context, key string) (*GCRAState, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	state, ok := d.gcra[key]
+	if ok == false {
+		return nil, nil
+	}
+	return &state, nil
+}
+
+func (d *DummyStorage) CompareAndSetGCRA(_ context.Context, key string, old, state *GCRAState, _ time.Duration) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	current, ok := d.gcra[key]
+	if ok != (old != nil) || ok && current.String() != old.String() {
+		return false, nil
+	}
+	d.gcra[key] = *state
+	return true, nil
+}
+
+func (d *DummyStorage) DeleteGCRA(_ context.Context, key string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.gcra, key)
+	return nil
+}
+
+func (d *DummyStorage) GetLog(_ context.Context, key string, now time.Time) (*EventLog, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	log, ok := d.logs[key]
+	if ok == false {
+		return nil, nil
+	}
+	log.window(now)
+	copied := *log
+	copied.Events = append([]Event(nil), log.Events...)
+	return &copied, nil
+}
+
+func (d *DummyStorage) AddEvent(_ context.Context, key string, limit int64, duration time.Duration, event Event, _ time.Duration) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	log, ok := d.logs[key]
+	if ok == false {
+		log = &EventLog{}
+		d.logs[key] = log
+	}
+	since := event.Time.Add(-duration)
+	used := event.Count
+	for _, e := range log.Events {
+		if e.Time.After(since) {
+			used += e.Count
+		}
+	}
+	if used > limit {
+		return false, nil
+	}
+	log.Limit, log.Duration = limit, duration
+	log.Events = append(log.Events, event)
+	return true, nil
+}
+
+func (d *DummyStorage) SetLog(_ context.Context, key string, log *EventLog, _ time.Duration) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	copied := *log
+	copied.Events = append([]Event(nil), log.Events...)
+	d.logs[key] = &copied
+	return nil
+}
+
+func (d *DummyStorage) DeleteLog(_ context.Context, key string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.logs, key)
+	return nil
+}
+
+func (d *DummyStorage) GetCounters(_ context.Context, key string, starts []time.Time) (*Counters, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	c, ok := d.counters[key]
+	if ok == false {
+		return nil, nil
+	}
+	counters := &Counters{Limit: c.Limit, Duration: c.Duration, Counts: make([]int64, len(starts))}
+	for i, start := range starts {
+		counters.Counts[i] = c.windows[start.UnixNano()]
+	}
+	return counters, nil
+}
+
+func (d *DummyStorage) IncrCounter(_ context.Context, key string, start time.Time, delta, limit int64, duration, expire time.Duration) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c, ok := d.counters[key]
+	if ok == false {
+		c = &dummyCounters{windows: make(map[int64]int64)}
+		d.counters[key] = c
+	}
+	c.Limit, c.Duration = limit, duration
+	// Drop the windows that would have expired by now
+	for s := range c.windows {
+		if s+int64(expire) <= start.UnixNano() {
+			delete(c.windows, s)
+		}
+	}
+	count := c.windows[start.UnixNano()] + delta
+	if count < 0 {
+		count = 0
+	}
+	c.windows[start.UnixNano()] = count
+	return count, nil
+}
+
+func (d *DummyStorage) DeleteCounters(_ context.Context, key string, _ []time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.counters, key)
+	return nil
+}
+
+func (d *DummyStorage) AcquireLease(_ context.Context, key, id string, limit int64, now, expires time.Time) (*Leases, bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	held, ok := d.leases[key]
+	if ok == false {
+		held = make(map[string]time.Time)
+		d.leases[key] = held
+	}
+	for id, expiry := range held {
+		if !now.Before(expiry) {
+			delete(held, id)
+		}
+	}
+	acquired := int64(len(held)) < limit
+	if acquired {
+		held[id] = expires
+	}
+	leases := &Leases{Held: int64(len(held))}
+	for _, expiry := range held {
+		if leases.First.IsZero() || expiry.Before(leases.First) {
+			leases.First = expiry
+		}
+		if expiry.After(leases.Last) {
+			leases.Last = expiry
+		}
+	}
+	return leases, acquired, nil
+}
+
+func (d *DummyStorage) ReleaseLease(_ context.Context, key, id string, now time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	expiry, ok := d.leases[key][id]
+	if ok == false || !now.Before(expiry) {
+		return ErrLeaseNotFound
+	}
+	delete(d.leases[key], id)
+	return nil
+}
+
+// limitMeta encodes the limit and duration that the network storages keep
+// next to the state of the algorithms that do not fit in a TokenBucket.
+func limitMeta(limit int64, duration time.Duration) string {
+	return fmt.Sprintf("%d %d", limit, int64(duration))
+}
+
+// withContext runs f on its own goroutine and returns as soon as either f
+// finishes or ctx is done. The client libraries used by the network
+// storages are not context aware, so an abandoned call keeps running in
+// the background until it completes and releases its connection. Limiters
+// never abandon calls, see startedContext.
+func withContext(ctx context.Context, f func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if ctx.Done() == nil {
+		return f()
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- f()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
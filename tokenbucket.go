@@ -1,7 +1,11 @@
 package ratelimit
 
 import (
+	"bytes"
+	"encoding/gob"
 	"errors"
+	"math"
+	"math/bits"
 	"time"
 )
 
@@ -9,39 +13,309 @@ var (
 	ErrLimitReached = errors.New("Limit reached")
 )
 
+// Tokens is an amount of tokens in fixed point. Buckets count in
+// millionths of a token, so that every refill is an exact integer and
+// millions of requests add up to the same usage as one large one. A finer
+// unit would leave less room for limits: see MaxTokens.
+type Tokens int64
+
+// Token is one whole token.
+const Token Tokens = 1000000
+
+// MaxTokens is the largest limit or burst a bucket can have.
+const MaxTokens = math.MaxInt64 / int64(Token)
+
+// tokens returns n whole tokens, saturating instead of overflowing.
+func tokens(n int64) Tokens {
+	switch {
+	case n > MaxTokens:
+		return math.MaxInt64
+	case n < -MaxTokens:
+		return -math.MaxInt64
+	}
+	return Tokens(n) * Token
+}
+
+// Ceil returns t rounded up to whole tokens.
+func (t Tokens) Ceil() int64 {
+	whole := int64(t / Token)
+	if t%Token > 0 {
+		whole++
+	}
+	return whole
+}
+
+// Float64 returns t in tokens.
+func (t Tokens) Float64() float64 {
+	return float64(t) / float64(Token)
+}
+
+// A TokenBucket refills at Limit tokens per Duration. It holds Burst
+// tokens, or Limit tokens if Burst is zero, so that a bucket can refill
+// slowly and still allow larger bursts, or the other way around. Used
+// is only more than the capacity when the bucket is in debt, see Charge.
+// Remainder is the part of the refill since LastAccessTime that does not
+// make a whole unit of Tokens yet, in units times nanoseconds of Duration.
+// Carrying it over is what keeps frequent refills from drifting.
 type TokenBucket struct {
-	Used           float64
+	Used           Tokens
 	LastAccessTime time.Time
-	Limit          float64
+	Limit          int64
 	Duration       time.Duration
+	Burst          int64
+	Remainder      int64
 }
 
-func NewTokenBucket(limit float64, duration time.Duration) *TokenBucket {
-	return &TokenBucket{0, time.Now(), limit, duration}
+// A Migration decides what happens to the usage of a bucket when a
+// request changes its limit or duration. Either way the usage is kept, so
+// that clients cannot empty their bucket by sending other parameters.
+type Migration int
+
+const (
+	// CarryOver keeps the tokens used as they are.
+	CarryOver Migration = iota
+	// Rescale keeps the share of the limit that is used.
+	Rescale
+)
+
+func NewTokenBucket(limit int64, duration time.Duration) *TokenBucket {
+	return NewTokenBucketAt(limit, duration, time.Now())
 }
 
-func (bucket *TokenBucket) Consume(count float64) error {
-	now := time.Now()
-	used := bucket.GetAdjustedUsage(now)
+// NewTokenBucketAt returns an empty bucket as of now.
+func NewTokenBucketAt(limit int64, duration time.Duration, now time.Time) *TokenBucket {
+	return &TokenBucket{0, now, limit, duration, 0, 0}
+}
 
-	if used+count <= bucket.Limit {
-		bucket.Used = used + count
-		bucket.LastAccessTime = now
+// Capacity returns how many tokens the bucket holds.
+func (bucket *TokenBucket) Capacity() int64 {
+	if bucket.Burst > 0 {
+		return bucket.Burst
+	}
+	return bucket.Limit
+}
+
+// RefillTime returns how long the bucket takes to refill from empty, after
+// which it is no different from a new bucket.
+func (bucket *TokenBucket) RefillTime() time.Duration {
+	if bucket.Burst <= 0 {
+		return bucket.Duration
+	}
+	return saturate(mulDiv(uint64(bucket.Burst), uint64(bucket.Duration), uint64(bucket.Limit), true))
+}
+
+func (bucket *TokenBucket) Consume(count int64) error {
+	return bucket.ConsumeAt(count, time.Now())
+}
+
+// ConsumeAt is Consume with the refill computed up to now.
+func (bucket *TokenBucket) ConsumeAt(count int64, now time.Time) error {
+	adjusted := *bucket
+	adjusted.advance(now)
+
+	capacity := adjusted.Capacity()
+	if count <= capacity && adjusted.Used <= tokens(capacity-count) {
+		adjusted.Used += tokens(count)
+		*bucket = adjusted
 		return nil
 	}
 
 	return ErrLimitReached
 }
 
-func (bucket *TokenBucket) GetAdjustedUsage(now time.Time) float64 {
-	used := bucket.Used
-	if bucket.LastAccessTime.Unix() > 0 {
-		elapsed := now.Sub(bucket.LastAccessTime)
-		back := bucket.Limit * float64(elapsed) / float64(bucket.Duration)
-		used -= back
-		if used < 0 {
-			used = 0
+// Charge consumes count tokens even if the bucket does not have them. The
+// usage past the capacity is debt, and nothing can be consumed until
+// refill has repaid it.
+func (bucket *TokenBucket) Charge(count int64) {
+	bucket.ChargeAt(count, time.Now())
+}
+
+// ChargeAt is Charge with the refill computed up to now.
+func (bucket *TokenBucket) ChargeAt(count int64, now time.Time) {
+	bucket.advance(now)
+	if bucket.Used > math.MaxInt64-tokens(count) {
+		bucket.Used = math.MaxInt64
+		return
+	}
+	bucket.Used += tokens(count)
+}
+
+// Refund gives count tokens back to the bucket. Usage never drops below
+// zero, so refunding tokens that have already been refilled is a no-op.
+func (bucket *TokenBucket) Refund(count int64) {
+	bucket.RefundAt(count, time.Now())
+}
+
+// RefundAt is Refund with the refill computed up to now.
+func (bucket *TokenBucket) RefundAt(count int64, now time.Time) {
+	bucket.advance(now)
+	if bucket.Used <= tokens(count) {
+		bucket.Used = 0
+		bucket.Remainder = 0
+		return
+	}
+	bucket.Used -= tokens(count)
+}
+
+// Migrate changes the limit and duration of the bucket as of now, keeping
+// its usage according to migration.
+func (bucket *TokenBucket) Migrate(limit int64, duration time.Duration, migration Migration, now time.Time) {
+	bucket.MigrateBurst(limit, bucket.Burst, duration, migration, now)
+}
+
+// MigrateBurst is Migrate that changes the burst of the bucket too. Rescale
+// keeps the share of the capacity that is used, rounded up.
+func (bucket *TokenBucket) MigrateBurst(limit, burst int64, duration time.Duration, migration Migration, now time.Time) {
+	bucket.advance(now)
+	capacity := bucket.Capacity()
+	bucket.Limit = limit
+	bucket.Burst = burst
+	bucket.Duration = duration
+	// The remainder is a fraction of the old rate
+	bucket.Remainder = 0
+	if migration == Rescale && capacity > 0 {
+		used := mulDiv(uint64(bucket.Used), uint64(bucket.Capacity()), uint64(capacity), true)
+		if used > math.MaxInt64 {
+			used = math.MaxInt64
+		}
+		bucket.Used = Tokens(used)
+	}
+}
+
+func (bucket *TokenBucket) GetAdjustedUsage(now time.Time) Tokens {
+	adjusted := *bucket
+	adjusted.advance(now)
+	return adjusted.Used
+}
+
+// WaitTime returns how long after now the bucket will have refilled
+// enough to consume count tokens. It is zero if they are available now.
+func (bucket *TokenBucket) WaitTime(count int64, now time.Time) time.Duration {
+	adjusted := *bucket
+	adjusted.advance(now)
+	excess := adjusted.Used - tokens(adjusted.Capacity()) + tokens(count)
+	if excess <= 0 || adjusted.Limit <= 0 {
+		return 0
+	}
+	// The shortest time whose refill, on top of the remainder, is excess
+	hi, lo := bits.Mul64(uint64(excess), uint64(adjusted.Duration))
+	lo, borrow := bits.Sub64(lo, uint64(adjusted.Remainder), 0)
+	hi -= borrow
+	rate := uint64(adjusted.Limit) * uint64(Token)
+	if hi >= rate {
+		return math.MaxInt64
+	}
+	quo, rem := bits.Div64(hi, lo, rate)
+	if rem > 0 {
+		quo++
+	}
+	// A clock behind the last access waits for it first
+	if behind := adjusted.LastAccessTime.Sub(now); behind > 0 {
+		return saturate(quo + uint64(behind))
+	}
+	return saturate(quo)
+}
+
+// advance refills the bucket up to now. Time never goes back, so a clock
+// behind LastAccessTime refills nothing.
+func (bucket *TokenBucket) advance(now time.Time) {
+	refill, remainder := bucket.refill(now)
+	if refill >= bucket.Used {
+		bucket.Used = 0
+		bucket.Remainder = 0
+	} else {
+		bucket.Used -= refill
+		bucket.Remainder = remainder
+	}
+	if now.After(bucket.LastAccessTime) {
+		bucket.LastAccessTime = now
+	}
+}
+
+// refill returns the units refilled between LastAccessTime and now, and
+// what is left of the division by Duration to carry over to the next one.
+func (bucket *TokenBucket) refill(now time.Time) (Tokens, int64) {
+	elapsed := now.Sub(bucket.LastAccessTime)
+	if bucket.LastAccessTime.Unix() <= 0 || elapsed <= 0 || bucket.Limit <= 0 || bucket.Duration <= 0 {
+		return 0, bucket.Remainder
+	}
+	hi, lo := bits.Mul64(uint64(bucket.Limit)*uint64(Token), uint64(elapsed))
+	lo, carry := bits.Add64(lo, uint64(bucket.Remainder), 0)
+	hi += carry
+	if hi >= uint64(bucket.Duration) {
+		return math.MaxInt64, 0
+	}
+	quo, rem := bits.Div64(hi, lo, uint64(bucket.Duration))
+	if quo > math.MaxInt64 {
+		return math.MaxInt64, 0
+	}
+	return Tokens(quo), int64(rem)
+}
+
+// saturate converts nanoseconds to a Duration, capping at the longest one.
+func saturate(ns uint64) time.Duration {
+	if ns > math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return time.Duration(ns)
+}
+
+// storedBucket is how the network storages encode a TokenBucket. Buckets
+// stored before Tokens existed have a float64 Used and no Version, and
+// Limit and Burst stay float64 so that they still decode. Used is written
+// too, so that those versions can read newer buckets.
+type storedBucket struct {
+	Used           float64
+	LastAccessTime time.Time
+	Limit          float64
+	Duration       time.Duration
+	Burst          float64
+	Version        int
+	Units          int64
+	Remainder      int64
+}
+
+// storedBucketVersion is the Version of buckets that count in Tokens.
+const storedBucketVersion = 1
+
+func encodeBucket(bucket *TokenBucket) ([]byte, error) {
+	var buffer bytes.Buffer
+	err := gob.NewEncoder(&buffer).Encode(storedBucket{
+		Used:           bucket.Used.Float64(),
+		LastAccessTime: bucket.LastAccessTime,
+		Limit:          float64(bucket.Limit),
+		Duration:       bucket.Duration,
+		Burst:          float64(bucket.Burst),
+		Version:        storedBucketVersion,
+		Units:          int64(bucket.Used),
+		Remainder:      bucket.Remainder,
+	})
+	return buffer.Bytes(), err
+}
+
+// decodeBucket decodes a bucket of any version. The float64 usage of old
+// buckets is rounded to the nearest unit.
+func decodeBucket(data []byte) (*TokenBucket, error) {
+	var stored storedBucket
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&stored)
+	if err != nil {
+		return nil, err
+	}
+	bucket := &TokenBucket{
+		Used:           Tokens(stored.Units),
+		LastAccessTime: stored.LastAccessTime,
+		Limit:          int64(stored.Limit),
+		Duration:       stored.Duration,
+		Burst:          int64(stored.Burst),
+		Remainder:      stored.Remainder,
+	}
+	if stored.Version < storedBucketVersion {
+		used := math.Round(stored.Used * float64(Token))
+		if used > math.MaxInt64 {
+			used = math.MaxInt64
 		}
+		bucket.Used = Tokens(used)
+		bucket.Remainder = 0
 	}
-	return used
+	return bucket, nil
 }
@@ -1,6 +1,11 @@
 package ratelimit
 
 import (
+	"bytes"
+	"encoding/gob"
+	"math"
+	"math/big"
+	"math/rand"
 	"testing"
 	"time"
 )
@@ -18,7 +23,7 @@ func TestConsume(t *testing.T) {
 func TestLimitError(t *testing.T) {
 	duration := time.Second * 100
 	bucket := NewTokenBucket(10, duration)
-	bucket.Used = 10
+	bucket.Used = 10 * Token
 	err := bucket.Consume(1)
 	if err != ErrLimitReached {
 		t.Error("Consume should fail")
@@ -28,7 +33,7 @@ func TestLimitError(t *testing.T) {
 func TestEnoughTimePassed(t *testing.T) {
 	duration := time.Second * 100
 	bucket := &TokenBucket{
-		Used:           10,
+		Used:           10 * Token,
 		LastAccessTime: time.Now().Add(-(duration / 2)),
 		Limit:          10,
 		Duration:       duration,
@@ -43,7 +48,7 @@ func TestEnoughTimePassed(t *testing.T) {
 func TestMoreThanEnoughTimePassed(t *testing.T) {
 	duration := time.Second * 100
 	bucket := &TokenBucket{
-		Used:           10,
+		Used:           10 * Token,
 		LastAccessTime: time.Now().Add(-(duration * 2)),
 		Limit:          10,
 		Duration:       duration,
@@ -61,7 +66,7 @@ func TestMoreThanEnoughTimePassed(t *testing.T) {
 func TestNotEnoughTimePassed(t *testing.T) {
 	duration := time.Second * 100
 	bucket := NewTokenBucket(10, duration)
-	bucket.Used = 10
+	bucket.Used = 10 * Token
 	bucket.LastAccessTime = time.Now().Add(-(duration / 20))
 
 	err := bucket.Consume(1)
@@ -73,15 +78,15 @@ func TestNotEnoughTimePassed(t *testing.T) {
 func Test5Added1Used(t *testing.T) {
 	duration := time.Second * 100
 	bucket := NewTokenBucket(10, duration)
-	bucket.Used = 8
+	bucket.Used = 8 * Token
 	bucket.LastAccessTime = time.Now().Add(-(duration / 2))
 
 	err := bucket.Consume(1)
 	if err == ErrLimitReached {
 		t.Error("Consume shouldn't fail")
 	}
-	if int64(bucket.Used) != 3 {
-		t.Error("bucket.Used should be greater than 3 and less than 4", bucket.Used)
+	if bucket.Used <= 3*Token || bucket.Used > 4*Token {
+		t.Error("bucket.Used should be greater than 3 and at most 4", bucket.Used)
 	}
 }
 
@@ -91,7 +96,7 @@ func Test5Added1Used(t *testing.T) {
 func TestFractionalTime(t *testing.T) {
 	duration := time.Second * 100
 	bucket := NewTokenBucket(10, duration)
-	bucket.Used = 10
+	bucket.Used = 10 * Token
 	bucket.LastAccessTime = time.Now().Add(-(time.Second * 54))
 	err := bucket.Consume(1)
 	t.Log(bucket)
@@ -99,7 +104,7 @@ func TestFractionalTime(t *testing.T) {
 		t.Error(err)
 	}
 
-	if usage := bucket.GetAdjustedUsage(time.Now()); usage > 5.6 && usage < 5.7 {
+	if usage := bucket.GetAdjustedUsage(time.Now()); usage > 56*Token/10 && usage < 57*Token/10 {
 		t.Error("Adjusted Usage should be greater than 5.6 and less than 5.7",
 			usage,
 		)
@@ -111,10 +116,249 @@ func TestFractionalTime(t *testing.T) {
 	}
 	t.Log(bucket)
 
-	if usage := bucket.GetAdjustedUsage(time.Now()); usage > 5.4 && usage < 5.5 {
+	if usage := bucket.GetAdjustedUsage(time.Now()); usage > 54*Token/10 && usage < 55*Token/10 {
 		t.Error("Adjusted Usage should be greater than 5.4 and less than 5.5",
 			usage,
 		)
 	}
 
 }
+
+func TestWaitTime(t *testing.T) {
+	duration := time.Second * 100
+	now := time.Now()
+	bucket := &TokenBucket{
+		Used:           10 * Token,
+		LastAccessTime: now,
+		Limit:          10,
+		Duration:       duration,
+	}
+	if wait := bucket.WaitTime(3, now); wait != time.Second*30 {
+		t.Error("Wait time should be 30s", wait)
+	}
+	if wait := bucket.WaitTime(3, now.Add(time.Second*10)); wait != time.Second*20 {
+		t.Error("Wait time should be 20s", wait)
+	}
+	if wait := bucket.WaitTime(3, now.Add(time.Second*30)); wait != 0 {
+		t.Error("Wait time should be 0", wait)
+	}
+}
+
+func TestRefund(t *testing.T) {
+	duration := time.Second * 100
+	bucket := NewTokenBucket(10, duration)
+	bucket.Consume(8)
+	bucket.Refund(5)
+	if bucket.Used.Ceil() != 3 {
+		t.Error("bucket.Used should be 3", bucket.Used)
+	}
+	bucket.Refund(5)
+	if bucket.Used != 0 {
+		t.Error("bucket.Used cannot be less than zero", bucket.Used)
+	}
+}
+
+func TestConsumeAt(t *testing.T) {
+	duration := time.Second * 100
+	now := time.Now()
+	bucket := NewTokenBucketAt(10, duration, now)
+	if err := bucket.ConsumeAt(10, now); err != nil {
+		t.Error(err)
+	}
+	if err := bucket.ConsumeAt(3, now.Add(time.Second*29)); err != ErrLimitReached {
+		t.Error("Consume should fail")
+	}
+	if err := bucket.ConsumeAt(3, now.Add(time.Second*30)); err != nil {
+		t.Error("Consume shouldn't fail", err)
+	}
+	bucket.RefundAt(5, now.Add(time.Second*30))
+	if usage := bucket.GetAdjustedUsage(now.Add(time.Second * 30)); usage != 5*Token {
+		t.Error("Adjusted Usage should be 5", usage)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	duration := time.Second * 100
+	now := time.Now()
+	bucket := NewTokenBucketAt(10, duration, now)
+	bucket.ConsumeAt(10, now)
+	bucket.Migrate(20, duration, CarryOver, now.Add(time.Second*10))
+	if bucket.Used != 9*Token || bucket.Limit != 20 {
+		t.Error("Used tokens should carry over", bucket)
+	}
+	bucket.Migrate(10, duration*2, Rescale, now.Add(time.Second*10))
+	if bucket.Used != 45*Token/10 || bucket.Duration != duration*2 {
+		t.Error("Used tokens should be rescaled", bucket)
+	}
+}
+
+func TestBurst(t *testing.T) {
+	now := time.Now()
+	// 10 tokens per second, up to 50 at once
+	bucket := NewTokenBucketAt(10, time.Second, now)
+	bucket.Burst = 50
+	if err := bucket.ConsumeAt(50, now); err != nil {
+		t.Error("The whole burst should be available", err)
+	}
+	if err := bucket.ConsumeAt(1, now); err != ErrLimitReached {
+		t.Error("Consume should fail")
+	}
+	if wait := bucket.WaitTime(10, now); wait != time.Second {
+		t.Error("Tokens should refill at the limit", wait)
+	}
+	if err := bucket.ConsumeAt(10, now.Add(time.Second)); err != nil {
+		t.Error("Consume shouldn't fail", err)
+	}
+	if refill := bucket.RefillTime(); refill != time.Second*5 {
+		t.Error("An empty bucket should refill in 5s", refill)
+	}
+	bucket.MigrateBurst(10, 100, time.Second, Rescale, now.Add(time.Second))
+	if bucket.Used != 100*Token {
+		t.Error("Used tokens should be rescaled to the capacity", bucket)
+	}
+}
+
+func TestBurstExpire(t *testing.T) {
+	now := time.Now()
+	// A burst that takes longer to refill than durations go
+	bucket := NewTokenBucketAt(1, time.Hour, now)
+	bucket.Burst = 10000000
+	if refill := bucket.RefillTime(); refill != math.MaxInt64 {
+		t.Error("The refill time should saturate", refill)
+	}
+	if millis := expireMillis(bucket.RefillTime()); millis != math.MaxInt64/int64(time.Millisecond)+1 {
+		t.Error("A saturated expiry should not overflow", millis)
+	}
+	if millis := expireMillis(time.Microsecond); millis != 1 {
+		t.Error("Short expiries should be rounded up", millis)
+	}
+}
+
+// Buckets stored with float64 usage, with or without a burst, decode to
+// the same usage in Tokens, and new buckets keep their remainder.
+func TestDecodeBucket(t *testing.T) {
+	type oldTokenBucket struct {
+		Used           float64
+		LastAccessTime time.Time
+		Limit          float64
+		Duration       time.Duration
+	}
+	type burstTokenBucket struct {
+		Used           float64
+		LastAccessTime time.Time
+		Limit          float64
+		Duration       time.Duration
+		Burst          float64
+	}
+	now := time.Now()
+	var buffer bytes.Buffer
+	gob.NewEncoder(&buffer).Encode(oldTokenBucket{4.5, now, 10, time.Minute})
+	bucket, err := decodeBucket(buffer.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bucket.Used != 45*Token/10 || bucket.Burst != 0 || bucket.Capacity() != 10 || bucket.RefillTime() != time.Minute {
+		t.Error("Old buckets should hold their limit", bucket)
+	}
+
+	buffer.Reset()
+	gob.NewEncoder(&buffer).Encode(burstTokenBucket{0.1, now, 10, time.Minute, 20})
+	bucket, err = decodeBucket(buffer.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bucket.Used != Token/10 || bucket.Burst != 20 || !bucket.LastAccessTime.Equal(now) {
+		t.Error("Buckets with a burst should decode", bucket)
+	}
+
+	bucket.Remainder = 7
+	data, err := encodeBucket(bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := decodeBucket(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Used != bucket.Used || decoded.Remainder != 7 || decoded.Burst != 20 {
+		t.Error("Buckets should be stored", decoded)
+	}
+	var old burstTokenBucket
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&old); err != nil || old.Used != 0.1 {
+		t.Error("Old versions should read new buckets", old, err)
+	}
+}
+
+// Refilling in many small steps adds up to exactly one large refill.
+func TestRefillNoDrift(t *testing.T) {
+	n := 2000000
+	if testing.Short() {
+		n = 100000
+	}
+	random := rand.New(rand.NewSource(1))
+	now := time.Now()
+	// A rate that is no whole number of units per nanosecond
+	bucket := NewTokenBucketAt(1000000000, 7*time.Second, now)
+	bucket.ConsumeAt(1000000000, now)
+	whole := *bucket
+	for i := 0; i < n; i++ {
+		now = now.Add(time.Duration(random.Int63n(2000)))
+		bucket.RefundAt(0, now)
+	}
+	if used := whole.GetAdjustedUsage(now); bucket.Used != used {
+		t.Error("Usage should not drift", bucket.Used, used)
+	}
+}
+
+// Usage is always what was consumed minus the exact refill since the
+// start, as long as the bucket never empties.
+func TestConsumeNoDrift(t *testing.T) {
+	n := 2000000
+	if testing.Short() {
+		n = 100000
+	}
+	random := rand.New(rand.NewSource(1))
+	start := time.Now()
+	now := start
+	limit, duration := int64(3), 7*time.Second
+	bucket := NewTokenBucketAt(limit, duration, now)
+	bucket.Burst = 1000
+	bucket.ConsumeAt(1000, now)
+	consumed := int64(1000)
+	for i := 0; i < n; i++ {
+		now = now.Add(time.Duration(random.Int63n(4000000)))
+		if bucket.WaitTime(1, now) == 0 {
+			bucket.ConsumeAt(1, now)
+			consumed++
+		} else {
+			bucket.RefundAt(0, now)
+		}
+		if bucket.Used == 0 {
+			t.Fatal("The bucket should not empty", i)
+		}
+	}
+	refill := new(big.Int).Mul(big.NewInt(limit*int64(Token)), big.NewInt(int64(now.Sub(start))))
+	refill.Quo(refill, big.NewInt(int64(duration)))
+	expected := new(big.Int).Sub(big.NewInt(consumed*int64(Token)), refill)
+	if expected.Cmp(big.NewInt(int64(bucket.Used))) != 0 {
+		t.Error("Usage should not drift", bucket.Used, expected)
+	}
+}
+
+func TestLargeLimit(t *testing.T) {
+	now := time.Now()
+	// A terabyte per second
+	bucket := NewTokenBucketAt(1000000000000, time.Second, now)
+	if err := bucket.ConsumeAt(1000000000000, now); err != nil {
+		t.Error("The whole limit should be available", err)
+	}
+	if wait := bucket.WaitTime(1, now); wait != time.Nanosecond {
+		t.Error("A token should refill in a nanosecond", wait)
+	}
+	if used := bucket.GetAdjustedUsage(now.Add(time.Second / 2)); used != 500000000000*Token {
+		t.Error("Half the bucket should refill in half the duration", used)
+	}
+	if err := checkPostArgs("key", 1, MaxTokens+1, 0, time.Second); err != ErrLimitTooLarge {
+		t.Error("Limits beyond MaxTokens should be rejected", err)
+	}
+}
@@ -0,0 +1,90 @@
+package ratelimit
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrNoWindows       = errors.New("At least one window is required")
+	ErrDuplicateWindow = errors.New("Windows should have different durations")
+)
+
+// A Window is one of the limits of a key posted with PostWindows, such as
+// 1000 tokens per hour.
+type Window struct {
+	Limit    int64
+	Duration time.Duration
+}
+
+// windowKey is where the state of one of the windows of key is kept.
+func windowKey(key string, duration time.Duration) string {
+	return fmt.Sprintf("%s#%s", key, duration)
+}
+
+func checkWindowsArgs(key string, count int64, windows []Window) error {
+	if len(windows) == 0 {
+		return ErrNoWindows
+	}
+	seen := make(map[time.Duration]bool, len(windows))
+	for _, window := range windows {
+		if err := checkPostArgs(key, count, window.Limit, 0, window.Duration); err != nil {
+			return err
+		}
+		if seen[window.Duration] {
+			return ErrDuplicateWindow
+		}
+		seen[window.Duration] = true
+	}
+	return nil
+}
+
+// handleWindows consumes the tokens of req from every window of req.key,
+// or from none of them if any window would reach its limit. The binding
+// window is the one that turned the request away, the one the caller has
+// to wait longest for if several did, or else the one with the fewest
+// tokens remaining.
+func handleWindows(storage Storage, settings settings, now time.Time, req request) response {
+	alg, err := lookupAlgorithm(req.algorithm)
+	if err != nil {
+		return response{err: err}
+	}
+	requests := make([]request, len(req.windows))
+	results := make([]Result, len(req.windows))
+	binding := -1
+	for i, window := range req.windows {
+		requests[i] = request{
+			ctx:      req.ctx,
+			method:   POST,
+			key:      windowKey(req.key, window.Duration),
+			count:    req.count,
+			limit:    window.Limit,
+			duration: window.Duration,
+		}
+		res := alg.post(storage, settings, now, requests[i], true)
+		if res.err != nil && res.err != ErrLimitReached {
+			return res
+		}
+		results[i] = res.result
+		if res.err == ErrLimitReached && (binding < 0 || res.result.RetryAfter > results[binding].RetryAfter) {
+			binding = i
+		}
+	}
+	if binding >= 0 {
+		return response{result: results[binding], multi: results, binding: binding, err: ErrLimitReached}
+	}
+	// Storages have no transactions, so a failing write may still leave
+	// the windows before it consumed
+	for i := range requests {
+		res := alg.post(storage, settings, now, requests[i], false)
+		if res.err != nil {
+			return res
+		}
+		results[i] = res.result
+		if binding < 0 || res.result.Remaining < results[binding].Remaining {
+			binding = i
+		}
+	}
+	return response{result: results[binding], multi: results, binding: binding}
+}
@@ -0,0 +1,96 @@
+package ratelimit
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPostWindows(t *testing.T) {
+	storage := NewDummyStorage()
+	clock := NewFakeClock(time.Now())
+	limiter := NewSingleThreadLimiter(storage)
+	limiter.SetClock(clock)
+	limiter.Start()
+	defer limiter.Stop()
+	ctx := context.Background()
+	windows := []Window{{10, time.Second}, {15, time.Hour}, {20, time.Hour * 24}}
+	results, binding, err := limiter.PostWindows(ctx, "testkey1", 8, windows, Options{})
+	if err != nil || len(results) != 3 || results[1].Used != 8 {
+		t.Error("Every window should be consumed", results, err)
+	}
+	if binding != 0 {
+		t.Error("The window of a second should be binding", binding)
+	}
+	results, binding, err = limiter.PostWindows(ctx, "testkey1", 8, windows, Options{})
+	if err != ErrLimitReached || binding != 1 {
+		t.Error("The hourly window should reach its limit", binding, err)
+	}
+	if results[0].RetryAfter != time.Millisecond*600 || results[1].RetryAfter != time.Minute*4 {
+		t.Error("Every window should report its wait", results)
+	}
+	if result, _ := limiter.GetContext(ctx, windowKey("testkey1", time.Hour*24), Options{}); result.Used != 8 {
+		t.Error("No window should be consumed", result)
+	}
+
+	clock.Advance(time.Minute * 4)
+	results, binding, err = limiter.PostWindows(ctx, "testkey1", 7, windows, Options{})
+	if err != nil || binding != 1 || results[1].Remaining != 1 {
+		t.Error("The hourly window should have the fewest tokens left", results, binding, err)
+	}
+
+	if _, _, err := limiter.PostWindows(ctx, "testkey1", 1, nil, Options{}); err != ErrNoWindows {
+		t.Error("Windows should be required", err)
+	}
+	if _, _, err := limiter.PostWindows(ctx, "testkey1", 1, []Window{{10, time.Hour}, {20, time.Hour}}, Options{}); err != ErrDuplicateWindow {
+		t.Error("Windows should have different durations", err)
+	}
+	if _, _, err := limiter.PostWindows(ctx, "testkey1", 11, windows, Options{}); err != ErrCountLimit {
+		t.Error("Count should fit in every window", err)
+	}
+}
+
+func TestPostWindowsAlgorithm(t *testing.T) {
+	limiter := NewShardedLimiter(NewDummyStorage(), 4)
+	ctx := context.Background()
+	opts := Options{Algorithm: AlgorithmFixedWindow}
+	windows := []Window{{5, time.Minute}, {3, time.Hour}}
+	for i := 0; i < 3; i++ {
+		if _, _, err := limiter.PostWindows(ctx, "testkey1", 1, windows, opts); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, binding, err := limiter.PostWindows(ctx, "testkey1", 1, windows, opts); err != ErrLimitReached || binding != 1 {
+		t.Error("The hourly window should reach its limit", binding, err)
+	}
+}
+
+func TestHttpServerWindows(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	httpServer := NewHttpServer(NewShardedLimiter(NewDummyStorage(), 1), logger)
+	post := func(query string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("POST", "/windows?"+query, nil)
+		httpServer.ServeHTTP(recorder, request)
+		return recorder
+	}
+	query := "key=testkey1&count=2&limit=10&duration=1s&limit=3&duration=1h"
+	recorder := post(query)
+	if recorder.Code != http.StatusOK || recorder.Header().Get("X-Ratelimit-Window") != "1" {
+		t.Error("The hourly window should be binding", recorder.Code, recorder.Header())
+	}
+	if recorder.Body.String() != "2\n" {
+		t.Error("Body should be the usage of the binding window", recorder.Body.String())
+	}
+	recorder = post(query)
+	if recorder.Code != http.StatusMethodNotAllowed || recorder.Header().Get("X-Ratelimit-Window") != "1" {
+		t.Error("The hourly window should reach its limit", recorder.Code, recorder.Header())
+	}
+	if recorder = post("key=testkey1&count=1&limit=10&duration=1s&limit=3"); recorder.Code != http.StatusBadRequest {
+		t.Error("Limits and durations should come in pairs", recorder.Code)
+	}
+}